@@ -0,0 +1,318 @@
+package env
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/template"
+)
+
+// envKeyPattern constrains tool.Env keys to valid shell identifiers. Keys
+// are rendered as-is into every activation script (as a bash/fish/nu
+// variable name, a PowerShell $env: member or a cmd "set" name) with no
+// escaping of their own, so anything outside this pattern - a newline or
+// "=", say - could inject its own statements into the generated script.
+var envKeyPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// activationExport is one resolved environment variable an activation
+// script needs to set: PATH entries get prepended to the existing PATH,
+// everything else is set outright.
+type activationExport struct {
+	Key    string
+	Value  string
+	IsPath bool
+}
+
+// activationData is the shared model every shell template renders from, so
+// a single `PATH: bin` in toolenv.yml produces the right export in bash,
+// fish, PowerShell, cmd and nushell alike.
+type activationData struct {
+	EnvName string
+	Exports []activationExport
+}
+
+type activationShell struct {
+	filename string
+	template string
+	// escape quotes a value the way this shell's double-quoted strings
+	// require, so a tool.Env value containing that shell's special
+	// characters renders as a literal path segment instead of breaking out
+	// of the string or, worse, being interpreted as code.
+	escape func(string) string
+}
+
+var activationShells = []activationShell{
+	{filename: "activate", template: bashActivateTemplate, escape: escapeBash},
+	{filename: "activate.fish", template: fishActivateTemplate, escape: escapeFish},
+	{filename: "activate.ps1", template: ps1ActivateTemplate, escape: escapePowerShell},
+	{filename: "activate.bat", template: batActivateTemplate, escape: escapeBat},
+	{filename: "activate.nu", template: nuActivateTemplate, escape: escapeNu},
+}
+
+// escapeBackslashQuoteDollar escapes the three characters special to
+// fish's, nu's and (alongside the backtick) bash's double-quoted strings:
+// "\" itself, the closing "\"", and "$" (variable expansion).
+func escapeBackslashQuoteDollar(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "$", `\$`).Replace(value)
+}
+
+// escapeBash escapes a value for bash's double-quoted strings: everything
+// escapeBackslashQuoteDollar covers, plus "`" (command substitution).
+func escapeBash(value string) string {
+	return strings.NewReplacer("`", "\\`").Replace(escapeBackslashQuoteDollar(value))
+}
+
+// escapeFish escapes a value for fish's double-quoted strings, where "\"
+// and "$" (variable expansion) need escaping in addition to the closing
+// quote itself.
+func escapeFish(value string) string {
+	return escapeBackslashQuoteDollar(value)
+}
+
+// escapePowerShell escapes a value for PowerShell's double-quoted strings,
+// where the backtick is itself the escape character and "$" triggers
+// variable expansion in addition to the closing quote.
+func escapePowerShell(value string) string {
+	return strings.NewReplacer("`", "``", `"`, "`\"", "$", "`$").Replace(value)
+}
+
+// escapeBat escapes a value for a batch `set "KEY=VALUE"` string, where
+// "%" triggers variable expansion. Batch has no escape for a literal
+// double quote inside a quoted string, so one is not supported here;
+// GenerateActivationScript rejects such values before writing activate.bat
+// rather than emit a script a quote could break out of.
+func escapeBat(value string) string {
+	return strings.ReplaceAll(value, "%", "%%")
+}
+
+// escapeNu escapes a value for nushell's double-quoted strings, where "\"
+// and "$" (variable expansion) need escaping in addition to the closing
+// quote itself.
+func escapeNu(value string) string {
+	return escapeBackslashQuoteDollar(value)
+}
+
+// GenerateActivationScript writes env_name/bin/activate and its
+// bash/fish/PowerShell/cmd/nushell counterparts.
+func GenerateActivationScript(env_name string, tools []Tool) error {
+	exports, err := resolveExports(tools)
+
+	if err != nil {
+		return err
+	}
+
+	for _, export := range exports {
+		if strings.Contains(export.Value, `"`) {
+			return fmt.Errorf("env value for %s contains a double quote, which activate.bat cannot safely escape: %q", export.Key, export.Value)
+		}
+	}
+
+	data := activationData{EnvName: env_name, Exports: exports}
+
+	for _, shell := range activationShells {
+		if err := renderActivationScript(shell, data); err != nil {
+			return fmt.Errorf("failed to write %s: %w", shell.filename, err)
+		}
+	}
+
+	return nil
+}
+
+func renderActivationScript(shell activationShell, data activationData) error {
+	tmpl, err := template.New(shell.filename).Funcs(template.FuncMap{"esc": shell.escape}).Parse(shell.template)
+
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return err
+	}
+
+	return os.WriteFile(filepath.Join(data.EnvName, "bin", shell.filename), buf.Bytes(), Permission)
+}
+
+// resolveExports templates every tool.Env value (e.g. "{{.version}}/bin")
+// once up front so all five shell templates render from the same,
+// already-resolved data. Each value is resolved relative to the tool's own
+// install directory (storage/<name>@<version>, matching how `install` lays
+// tools out), not the environment root, so "PATH: bin" in toolenv.yml points
+// at storage/<name>@<version>/bin rather than a directory that never exists.
+func resolveExports(tools []Tool) ([]activationExport, error) {
+	var exports []activationExport
+
+	for _, tool := range tools {
+		for key, value := range tool.Env {
+			if !envKeyPattern.MatchString(key) {
+				return nil, fmt.Errorf("tool %s: invalid env key %q: must look like a shell identifier ([A-Za-z_][A-Za-z0-9_]*), since it's rendered unescaped into every activation script", tool.Name, key)
+			}
+
+			tmpl, err := template.New("env").Parse(value)
+
+			if err != nil {
+				return nil, err
+			}
+
+			data := map[string]string{"version": tool.Version}
+
+			var buf bytes.Buffer
+
+			if err := tmpl.Execute(&buf, data); err != nil {
+				return nil, err
+			}
+
+			install_dir := filepath.Join("storage", fmt.Sprintf("%s@%s", tool.Name, tool.Version))
+
+			exports = append(exports, activationExport{
+				Key:    key,
+				Value:  filepath.Join(install_dir, buf.String()),
+				IsPath: key == "PATH",
+			})
+		}
+	}
+
+	return exports, nil
+}
+
+// ResolveExecutable finds name the way the shell would once pathEnv is on
+// PATH, without requiring the caller to already be running inside an
+// activated environment. os/exec.Command resolves argv[0] via LookPath
+// against the *calling* process's PATH at construction time, before
+// Cmd.Env is ever consulted, so `toolenv run -- <tool>` would otherwise
+// fail to find a tool that only exists on the environment's PATH. This
+// swaps PATH just long enough to run exec.LookPath against pathEnv instead.
+func ResolveExecutable(pathEnv, name string) (string, error) {
+	original, had := os.LookupEnv("PATH")
+
+	os.Setenv("PATH", pathEnv)
+
+	defer func() {
+		if had {
+			os.Setenv("PATH", original)
+		} else {
+			os.Unsetenv("PATH")
+		}
+	}()
+
+	return exec.LookPath(name)
+}
+
+// ActivationEnv computes the environment variables an activated
+// environment would export, without writing or sourcing a script. Used by
+// `toolenv run` to exec a command with the env's tools on PATH.
+func ActivationEnv(env_name string, tools []Tool) (map[string]string, error) {
+	toolenv_dir, err := filepath.Abs(env_name)
+
+	if err != nil {
+		return nil, err
+	}
+
+	exports, err := resolveExports(tools)
+
+	if err != nil {
+		return nil, err
+	}
+
+	resolved := map[string]string{}
+	path := os.Getenv("PATH")
+
+	for _, export := range exports {
+		value := filepath.Join(toolenv_dir, export.Value)
+
+		if export.IsPath {
+			path = value + string(os.PathListSeparator) + path
+		} else {
+			resolved[export.Key] = value
+		}
+	}
+
+	resolved["PATH"] = path
+
+	return resolved, nil
+}
+
+const bashActivateTemplate = `# This file must be used with "source {{.EnvName}}/bin/activate"
+# It modifies the current shell environment.
+export TOOLENV_DIR="$(pwd)/{{.EnvName}}"
+export PREVIOUS_PATH="$PATH"
+{{range .Exports}}{{if .IsPath}}export PATH="$TOOLENV_DIR/{{esc .Value}}:$PATH"
+{{else}}export {{.Key}}="$TOOLENV_DIR/{{esc .Value}}"
+{{end}}{{end}}export OLD_PS1="$PS1"
+export PS1="(toolenv:{{.EnvName}}) $PS1"
+deactivate() {
+	export PS1="$OLD_PS1"
+	unset OLD_PS1
+{{range .Exports}}{{if not .IsPath}}	unset {{.Key}}
+{{end}}{{end}}	export PATH=$PREVIOUS_PATH
+	unset PREVIOUS_PATH
+	unset TOOLENV_DIR
+	unset -f deactivate
+}`
+
+const fishActivateTemplate = `# This file must be used with "source {{.EnvName}}/bin/activate.fish"
+set -gx TOOLENV_DIR (pwd)/{{.EnvName}}
+set -gx PREVIOUS_PATH $PATH
+{{range .Exports}}{{if .IsPath}}set -gx PATH "$TOOLENV_DIR/{{esc .Value}}" $PATH
+{{else}}set -gx {{.Key}} "$TOOLENV_DIR/{{esc .Value}}"
+{{end}}{{end}}functions -c fish_prompt _toolenv_old_fish_prompt
+function fish_prompt
+	echo -n "(toolenv:{{.EnvName}}) "
+	_toolenv_old_fish_prompt
+end
+function deactivate
+	set -gx PATH $PREVIOUS_PATH
+	set -e PREVIOUS_PATH
+	set -e TOOLENV_DIR
+{{range .Exports}}{{if not .IsPath}}	set -e {{.Key}}
+{{end}}{{end}}	functions -c _toolenv_old_fish_prompt fish_prompt
+	functions -e _toolenv_old_fish_prompt
+	functions -e deactivate
+end`
+
+const ps1ActivateTemplate = `# This file must be used with ". {{.EnvName}}/bin/activate.ps1"
+$env:TOOLENV_DIR = "$(Get-Location)\{{.EnvName}}"
+$env:PREVIOUS_PATH = $env:PATH
+{{range .Exports}}{{if .IsPath}}$env:PATH = "$env:TOOLENV_DIR\{{esc .Value}};$env:PATH"
+{{else}}$env:{{.Key}} = "$env:TOOLENV_DIR\{{esc .Value}}"
+{{end}}{{end}}function global:deactivate {
+	$env:PATH = $env:PREVIOUS_PATH
+	Remove-Item Env:\PREVIOUS_PATH
+	Remove-Item Env:\TOOLENV_DIR
+{{range .Exports}}{{if not .IsPath}}	Remove-Item Env:\{{.Key}}
+{{end}}{{end}}	Remove-Item Function:\deactivate
+}`
+
+const batActivateTemplate = `@echo off
+if "%1"=="deactivate" goto deactivate
+
+set "TOOLENV_DIR=%CD%\{{.EnvName}}"
+set "PREVIOUS_PATH=%PATH%"
+{{range .Exports}}{{if .IsPath}}set "PATH=%TOOLENV_DIR%\{{esc .Value}};%PATH%"
+{{else}}set "{{.Key}}=%TOOLENV_DIR%\{{esc .Value}}"
+{{end}}{{end}}goto :eof
+
+:deactivate
+set "PATH=%PREVIOUS_PATH%"
+set "PREVIOUS_PATH="
+set "TOOLENV_DIR="
+{{range .Exports}}{{if not .IsPath}}set "{{.Key}}="
+{{end}}{{end}}goto :eof`
+
+const nuActivateTemplate = `# This file must be used with "overlay use {{.EnvName}}/bin/activate.nu"
+$env.TOOLENV_DIR = ($env.PWD | path join "{{.EnvName}}")
+$env.PREVIOUS_PATH = $env.PATH
+{{range .Exports}}{{if .IsPath}}$env.PATH = ($env.PATH | prepend ($env.TOOLENV_DIR | path join "{{esc .Value}}"))
+{{else}}$env.{{.Key}} = ($env.TOOLENV_DIR | path join "{{esc .Value}}")
+{{end}}{{end}}
+export def --env deactivate [] {
+	$env.PATH = $env.PREVIOUS_PATH
+	hide-env PREVIOUS_PATH
+	hide-env TOOLENV_DIR
+{{range .Exports}}{{if not .IsPath}}	hide-env {{.Key}}
+{{end}}{{end}}}`
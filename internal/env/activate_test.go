@@ -0,0 +1,206 @@
+package env
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestResolveExportsJoinsStorageInstallDir(t *testing.T) {
+	tools := []Tool{
+		{Name: "go", Version: "1.22.0", Env: map[string]string{"PATH": "bin"}},
+		{Name: "node", Version: "20.0.0", Env: map[string]string{"NODE_HOME": "{{.version}}/dist"}},
+	}
+
+	exports, err := resolveExports(tools)
+
+	if err != nil {
+		t.Fatalf("resolveExports failed: %v", err)
+	}
+
+	want := map[string]string{
+		"PATH":      filepath.Join("storage", "go@1.22.0", "bin"),
+		"NODE_HOME": filepath.Join("storage", "node@20.0.0", "20.0.0/dist"),
+	}
+
+	if len(exports) != len(want) {
+		t.Fatalf("resolveExports returned %d exports, want %d", len(exports), len(want))
+	}
+
+	for _, export := range exports {
+		if got, ok := want[export.Key]; !ok || got != export.Value {
+			t.Errorf("export %s = %q, want %q", export.Key, export.Value, want[export.Key])
+		}
+	}
+}
+
+func TestActivationEnvPrependsToolsOnPath(t *testing.T) {
+	t.Setenv("PATH", "/usr/bin")
+
+	env_name := t.TempDir()
+	tools := []Tool{{Name: "go", Version: "1.22.0", Env: map[string]string{"PATH": "bin"}}}
+
+	exports, err := ActivationEnv(env_name, tools)
+
+	if err != nil {
+		t.Fatalf("ActivationEnv failed: %v", err)
+	}
+
+	want_dir := filepath.Join(env_name, "storage", "go@1.22.0", "bin")
+
+	if !strings.HasPrefix(exports["PATH"], want_dir+string(os.PathListSeparator)) {
+		t.Errorf("PATH = %q, want it to start with %q", exports["PATH"], want_dir)
+	}
+
+	if !strings.HasSuffix(exports["PATH"], "/usr/bin") {
+		t.Errorf("PATH = %q, want it to still contain the original PATH", exports["PATH"])
+	}
+}
+
+func TestShellEscapersQuoteSpecialCharacters(t *testing.T) {
+	const raw = `bin"$(whoami)`
+
+	cases := []struct {
+		name   string
+		escape func(string) string
+		want   string
+	}{
+		{"bash", escapeBash, `bin\"\$(whoami)`},
+		{"fish", escapeFish, `bin\"\$(whoami)`},
+		{"powershell", escapePowerShell, "bin`\"`$(whoami)"},
+		{"bat", escapeBat, `bin"$(whoami)`},
+		{"nu", escapeNu, `bin\"\$(whoami)`},
+	}
+
+	for _, c := range cases {
+		if got := c.escape(raw); got != c.want {
+			t.Errorf("%s escape(%q) = %q, want %q", c.name, raw, got, c.want)
+		}
+	}
+}
+
+func TestGenerateActivationScriptEscapesEnvValues(t *testing.T) {
+	env_name := t.TempDir()
+
+	if err := os.MkdirAll(filepath.Join(env_name, "bin"), Permission); err != nil {
+		t.Fatal(err)
+	}
+
+	tools := []Tool{{Name: "go", Version: "1.22.0", Env: map[string]string{"GOFLAGS": "evil$(whoami)"}}}
+
+	if err := GenerateActivationScript(env_name, tools); err != nil {
+		t.Fatalf("GenerateActivationScript failed: %v", err)
+	}
+
+	// cmd has no "$" expansion to guard against, so it's the only shell
+	// that's expected to carry the literal, unescaped substring.
+	want := map[string]string{
+		"activate":      `evil\$(whoami)`,
+		"activate.fish": `evil\$(whoami)`,
+		"activate.ps1":  "evil`$(whoami)",
+		"activate.bat":  `evil$(whoami)`,
+		"activate.nu":   `evil\$(whoami)`,
+	}
+
+	for _, shell := range activationShells {
+		content, err := os.ReadFile(filepath.Join(env_name, "bin", shell.filename))
+
+		if err != nil {
+			t.Fatalf("reading %s: %v", shell.filename, err)
+		}
+
+		if !strings.Contains(string(content), want[shell.filename]) {
+			t.Errorf("%s does not contain the expected escaped value %q:\n%s", shell.filename, want[shell.filename], content)
+		}
+	}
+}
+
+func TestGenerateActivationScriptRejectsQuoteInEnvValue(t *testing.T) {
+	env_name := t.TempDir()
+
+	if err := os.MkdirAll(filepath.Join(env_name, "bin"), Permission); err != nil {
+		t.Fatal(err)
+	}
+
+	// activate.bat can't safely escape a quote inside its `set "K=V"`
+	// syntax, so GenerateActivationScript must refuse rather than write a
+	// script a quote could break out of.
+	tools := []Tool{{Name: "go", Version: "1.22.0", Env: map[string]string{"GOFLAGS": `-tags="evil"`}}}
+
+	if err := GenerateActivationScript(env_name, tools); err == nil {
+		t.Fatal("GenerateActivationScript did not reject an env value containing a double quote")
+	}
+}
+
+func TestResolveExportsRejectsInvalidEnvKey(t *testing.T) {
+	tools := []Tool{{Name: "go", Version: "1.22.0", Env: map[string]string{"FOO\nexport PWNED=1": "v"}}}
+
+	if _, err := resolveExports(tools); err == nil {
+		t.Fatal("resolveExports did not reject an env key that isn't a valid shell identifier")
+	}
+}
+
+func TestResolveExecutableFindsToolOnGivenPath(t *testing.T) {
+	bin_dir := t.TempDir()
+	script := filepath.Join(bin_dir, "mytool")
+
+	if err := os.WriteFile(script, []byte("#!/bin/sh\necho hi\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	resolved, err := ResolveExecutable(bin_dir, "mytool")
+
+	if err != nil {
+		t.Fatalf("ResolveExecutable failed: %v", err)
+	}
+
+	if resolved != script {
+		t.Errorf("ResolveExecutable = %q, want %q", resolved, script)
+	}
+}
+
+func TestResolveExecutableDoesNotLeakPathEnv(t *testing.T) {
+	t.Setenv("PATH", "/original/path")
+
+	bin_dir := t.TempDir()
+
+	if _, err := ResolveExecutable(bin_dir, "nonexistent-tool"); err == nil {
+		t.Fatal("ResolveExecutable found a tool that was never written")
+	}
+
+	if got := os.Getenv("PATH"); got != "/original/path" {
+		t.Errorf("PATH leaked as %q after ResolveExecutable, want %q", got, "/original/path")
+	}
+}
+
+func TestGenerateActivationScriptWritesAllShells(t *testing.T) {
+	env_name := t.TempDir()
+
+	if err := os.MkdirAll(filepath.Join(env_name, "bin"), Permission); err != nil {
+		t.Fatal(err)
+	}
+
+	tools := []Tool{{Name: "go", Version: "1.22.0", Env: map[string]string{"PATH": "bin"}}}
+
+	if err := GenerateActivationScript(env_name, tools); err != nil {
+		t.Fatalf("GenerateActivationScript failed: %v", err)
+	}
+
+	for _, shell := range activationShells {
+		path := filepath.Join(env_name, "bin", shell.filename)
+
+		content, err := os.ReadFile(path)
+
+		if err != nil {
+			t.Errorf("GenerateActivationScript did not write %s: %v", shell.filename, err)
+			continue
+		}
+
+		want := filepath.Join("storage", "go@1.22.0", "bin")
+
+		if !strings.Contains(string(content), want) {
+			t.Errorf("%s does not reference %q", shell.filename, want)
+		}
+	}
+}
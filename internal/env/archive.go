@@ -0,0 +1,333 @@
+package env
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ulikunitz/xz"
+)
+
+// archiveFormat identifies the container/compression scheme of a downloaded
+// tool archive, independent of what the source URL happens to be named.
+type archiveFormat int
+
+const (
+	formatUnknown archiveFormat = iota
+	formatTarGz
+	formatTarXz
+	formatZip
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	xzMagic   = []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}
+	zipMagic  = []byte{'P', 'K', 0x03, 0x04}
+)
+
+// detectArchiveFormat figures out how to extract a downloaded file. It first
+// trusts the URL's extension (so a ".tar.gz" or ".zip" download behaves as
+// expected), but falls back to sniffing the file's magic bytes because many
+// releases are served from URLs with query strings or redirect through a
+// path that doesn't end in the real extension.
+func detectArchiveFormat(url, filename string) (archiveFormat, error) {
+	if format := archiveFormatFromExtension(url); format != formatUnknown {
+		return format, nil
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return formatUnknown, err
+	}
+	defer f.Close()
+
+	header := make([]byte, 6)
+	n, err := io.ReadFull(f, header)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return formatUnknown, err
+	}
+	header = header[:n]
+
+	switch {
+	case bytes.HasPrefix(header, xzMagic):
+		return formatTarXz, nil
+	case bytes.HasPrefix(header, gzipMagic):
+		return formatTarGz, nil
+	case bytes.HasPrefix(header, zipMagic):
+		return formatZip, nil
+	default:
+		return formatUnknown, fmt.Errorf("unrecognized archive format for %q", url)
+	}
+}
+
+func archiveFormatFromExtension(url string) archiveFormat {
+	// Strip any query string before looking at the extension.
+	if idx := strings.IndexAny(url, "?#"); idx != -1 {
+		url = url[:idx]
+	}
+
+	switch {
+	case strings.HasSuffix(url, ".tar.gz"), strings.HasSuffix(url, ".tgz"):
+		return formatTarGz
+	case strings.HasSuffix(url, ".tar.xz"):
+		return formatTarXz
+	case strings.HasSuffix(url, ".zip"):
+		return formatZip
+	default:
+		return formatUnknown
+	}
+}
+
+// extractArchive extracts filename into install_dir, stripping the leading
+// path component the way `tar --strip-components=1` does so archives that
+// wrap their contents in a single top-level directory install flatly.
+func extractArchive(format archiveFormat, filename, install_dir string) error {
+	switch format {
+	case formatTarGz:
+		f, err := os.Open(filename)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return fmt.Errorf("failed to open gzip stream: %w", err)
+		}
+		defer gz.Close()
+
+		return extractTarReader(gz, install_dir)
+	case formatTarXz:
+		f, err := os.Open(filename)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		xzr, err := xz.NewReader(f)
+		if err != nil {
+			return fmt.Errorf("failed to open xz stream: %w", err)
+		}
+
+		return extractTarReader(xzr, install_dir)
+	case formatZip:
+		return extractZip(filename, install_dir)
+	default:
+		return fmt.Errorf("unsupported archive format")
+	}
+}
+
+func extractTarReader(r io.Reader, install_dir string) error {
+	tr := tar.NewReader(r)
+
+	for {
+		header, err := tr.Next()
+
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		name := stripLeadingComponent(header.Name)
+		if name == "" {
+			continue
+		}
+
+		target, err := safeJoin(install_dir, name)
+		if err != nil {
+			return err
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, Permission); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(target), Permission); err != nil {
+				return err
+			}
+
+			out, err := os.OpenFile(target, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, os.FileMode(header.Mode))
+			if err != nil {
+				return err
+			}
+
+			if _, err := io.Copy(out, tr); err != nil {
+				out.Close()
+				return err
+			}
+
+			out.Close()
+		case tar.TypeSymlink:
+			if err := safeSymlinkTarget(install_dir, target, header.Linkname); err != nil {
+				return err
+			}
+
+			if err := os.MkdirAll(filepath.Dir(target), Permission); err != nil {
+				return err
+			}
+
+			os.Remove(target)
+
+			if err := os.Symlink(header.Linkname, target); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func extractZip(filename, install_dir string) error {
+	r, err := zip.OpenReader(filename)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	for _, file := range r.File {
+		name := stripLeadingComponent(file.Name)
+		if name == "" {
+			continue
+		}
+
+		target, err := safeJoin(install_dir, name)
+		if err != nil {
+			return err
+		}
+
+		if file.Mode()&os.ModeSymlink != 0 {
+			if err := extractZipSymlink(install_dir, target, file); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if file.FileInfo().IsDir() {
+			if err := os.MkdirAll(target, Permission); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := os.MkdirAll(filepath.Dir(target), Permission); err != nil {
+			return err
+		}
+
+		src, err := file.Open()
+		if err != nil {
+			return err
+		}
+
+		out, err := os.OpenFile(target, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, file.Mode())
+		if err != nil {
+			src.Close()
+			return err
+		}
+
+		_, err = io.Copy(out, src)
+		src.Close()
+		out.Close()
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// extractZipSymlink recreates a symlink stored in a zip archive (via Unix
+// external file attributes, as many macOS/Linux-built zips do), the way
+// extractTarReader recreates tar.TypeSymlink entries. A zip symlink's
+// target is its "file" content rather than a header field, so it has to be
+// read out before it can be validated and recreated.
+func extractZipSymlink(install_dir, target string, file *zip.File) error {
+	src, err := file.Open()
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	linkname, err := io.ReadAll(src)
+	if err != nil {
+		return err
+	}
+
+	if err := safeSymlinkTarget(install_dir, target, string(linkname)); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(target), Permission); err != nil {
+		return err
+	}
+
+	os.Remove(target)
+
+	return os.Symlink(string(linkname), target)
+}
+
+// stripLeadingComponent implements `--strip-components=1`: it drops the
+// first path segment of name and returns the rest, or "" if name had no
+// segment beyond the top-level directory itself.
+func stripLeadingComponent(name string) string {
+	name = filepath.ToSlash(name)
+	parts := strings.SplitN(name, "/", 2)
+
+	if len(parts) < 2 {
+		return ""
+	}
+
+	return parts[1]
+}
+
+// safeJoin joins name onto install_dir and rejects any entry whose cleaned
+// path would escape install_dir, guarding against path traversal from
+// malicious or malformed archives (e.g. "../../etc/passwd").
+func safeJoin(install_dir, name string) (string, error) {
+	target := filepath.Join(install_dir, name)
+
+	if escapesDir(install_dir, target) {
+		return "", fmt.Errorf("archive entry %q escapes install directory", name)
+	}
+
+	return target, nil
+}
+
+// escapesDir reports whether target, once cleaned, falls outside dir.
+func escapesDir(dir, target string) bool {
+	rel, err := filepath.Rel(dir, target)
+	if err != nil {
+		return true
+	}
+
+	return rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// safeSymlinkTarget rejects a symlink entry whose Linkname would resolve
+// outside install_dir once the symlink is followed. An absolute Linkname
+// escapes by definition; a relative one is resolved against the symlink's
+// own directory, the way the filesystem would resolve it. Without this
+// check a malicious archive could ship a tar.TypeSymlink entry whose own
+// path is safe but whose target is "../../../../etc", pointing anywhere on
+// disk once followed.
+func safeSymlinkTarget(install_dir, target, linkname string) error {
+	if filepath.IsAbs(linkname) {
+		return fmt.Errorf("symlink %q has an absolute target %q", target, linkname)
+	}
+
+	resolved := filepath.Join(filepath.Dir(target), linkname)
+
+	if escapesDir(install_dir, resolved) {
+		return fmt.Errorf("symlink %q target %q escapes install directory", target, linkname)
+	}
+
+	return nil
+}
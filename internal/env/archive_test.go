@@ -0,0 +1,179 @@
+package env
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStripLeadingComponent(t *testing.T) {
+	cases := []struct {
+		name string
+		want string
+	}{
+		{"tool-1.2.3/bin/tool", "bin/tool"},
+		{"tool-1.2.3/", ""},
+		{"tool-1.2.3", ""},
+		{"a/b/c", "b/c"},
+	}
+
+	for _, c := range cases {
+		if got := stripLeadingComponent(c.name); got != c.want {
+			t.Errorf("stripLeadingComponent(%q) = %q, want %q", c.name, got, c.want)
+		}
+	}
+}
+
+func TestSafeJoin(t *testing.T) {
+	install_dir := filepath.Join(string(os.PathSeparator), "envs", "go")
+
+	if _, err := safeJoin(install_dir, "bin/go"); err != nil {
+		t.Errorf("safeJoin rejected a well-behaved entry: %v", err)
+	}
+
+	escaping := []string{
+		"../outside",
+		"../../etc/passwd",
+		"bin/../../outside",
+	}
+
+	for _, name := range escaping {
+		if _, err := safeJoin(install_dir, name); err == nil {
+			t.Errorf("safeJoin(%q) did not reject a path-traversal entry", name)
+		}
+	}
+}
+
+func TestSafeSymlinkTarget(t *testing.T) {
+	install_dir := filepath.Join(string(os.PathSeparator), "envs", "go")
+	target := filepath.Join(install_dir, "bin", "go")
+
+	if err := safeSymlinkTarget(install_dir, target, "../lib/go"); err != nil {
+		t.Errorf("safeSymlinkTarget rejected a target that stays inside install_dir: %v", err)
+	}
+
+	escaping := []string{
+		"../../../../etc/passwd",
+		"../../outside",
+	}
+
+	for _, linkname := range escaping {
+		if err := safeSymlinkTarget(install_dir, target, linkname); err == nil {
+			t.Errorf("safeSymlinkTarget(%q) did not reject an escaping relative target", linkname)
+		}
+	}
+
+	if err := safeSymlinkTarget(install_dir, target, "/etc/passwd"); err == nil {
+		t.Error("safeSymlinkTarget did not reject an absolute target")
+	}
+}
+
+func TestExtractTarReaderRejectsEscapingSymlink(t *testing.T) {
+	install_dir := t.TempDir()
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+
+	if err := tw.WriteHeader(&tar.Header{
+		Name:     "tool/bin/go",
+		Typeflag: tar.TypeSymlink,
+		Linkname: "../../../../etc/passwd",
+		Mode:     0777,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := extractTarReader(&buf, install_dir); err == nil {
+		t.Fatal("extractTarReader did not reject a symlink entry escaping install_dir")
+	}
+
+	if _, err := os.Lstat(filepath.Join(install_dir, "bin", "go")); err == nil {
+		t.Error("extractTarReader created the escaping symlink despite returning an error")
+	}
+}
+
+// writeZipSymlink writes a single symlink entry into w the way a
+// macOS/Linux-built zip would: as Unix external file attributes, with the
+// link target as the entry's content instead of a dedicated header field.
+func writeZipSymlink(w *zip.Writer, name, linkname string) error {
+	header := &zip.FileHeader{Name: name, Method: zip.Store}
+	header.SetMode(os.ModeSymlink | 0777)
+
+	out, err := w.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+
+	_, err = out.Write([]byte(linkname))
+	return err
+}
+
+func TestExtractZipPreservesSymlink(t *testing.T) {
+	install_dir := t.TempDir()
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+
+	if err := writeZipSymlink(zw, "tool/bin/go", "../lib/go"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	zip_path := filepath.Join(t.TempDir(), "archive.zip")
+
+	if err := os.WriteFile(zip_path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := extractZip(zip_path, install_dir); err != nil {
+		t.Fatalf("extractZip rejected a well-behaved symlink: %v", err)
+	}
+
+	got, err := os.Readlink(filepath.Join(install_dir, "bin", "go"))
+	if err != nil {
+		t.Fatalf("extractZip did not create the symlink: %v", err)
+	}
+
+	if got != "../lib/go" {
+		t.Errorf("symlink target = %q, want %q", got, "../lib/go")
+	}
+}
+
+func TestExtractZipRejectsEscapingSymlink(t *testing.T) {
+	install_dir := t.TempDir()
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+
+	if err := writeZipSymlink(zw, "tool/bin/go", "../../../../etc/passwd"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	zip_path := filepath.Join(t.TempDir(), "archive.zip")
+
+	if err := os.WriteFile(zip_path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := extractZip(zip_path, install_dir); err == nil {
+		t.Fatal("extractZip did not reject a symlink entry escaping install_dir")
+	}
+
+	if _, err := os.Lstat(filepath.Join(install_dir, "bin", "go")); err == nil {
+		t.Error("extractZip created the escaping symlink despite returning an error")
+	}
+}
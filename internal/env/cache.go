@@ -0,0 +1,329 @@
+package env
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+)
+
+const cacheCompleteMarker = ".toolenv-complete"
+const cacheLastUsedMarker = ".toolenv-last-used"
+
+// CacheRoot resolves the shared, content-addressed tool cache directory:
+// $XDG_CACHE_HOME/toolenv, falling back to $HOME/.cache/toolenv on
+// Linux/macOS or %LOCALAPPDATA%\toolenv on Windows.
+func CacheRoot() (string, error) {
+	if dir := os.Getenv("XDG_CACHE_HOME"); dir != "" {
+		return filepath.Join(dir, "toolenv"), nil
+	}
+
+	if runtime.GOOS == "windows" {
+		if dir := os.Getenv("LOCALAPPDATA"); dir != "" {
+			return filepath.Join(dir, "toolenv"), nil
+		}
+	}
+
+	home, err := os.UserHomeDir()
+
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve cache directory: %w", err)
+	}
+
+	return filepath.Join(home, ".cache", "toolenv"), nil
+}
+
+// CacheEntryDir returns the cache directory a given tool build is stored
+// under: tools/<name>/<version>/<os>-<arch>/<integrity-fingerprint>/. Folding
+// the resolved download url into the key, alongside the checksum and
+// signature, means a cache entry only ever satisfies an install whose
+// toolenv.yml still points at the same artifact it was downloaded and
+// verified from; two entries that share name/version/os/arch but fetch
+// from different urls (or a corrected checksum, or a rotated signing key)
+// simply miss each other's entry and the tool is re-downloaded and
+// re-verified rather than linked in unchecked.
+func CacheEntryDir(root, name, version, os_name, arch, url, checksum string, sig *Signature) string {
+	return filepath.Join(root, "tools", name, version, fmt.Sprintf("%s-%s", os_name, arch), integrityFingerprint(url, checksum, sig))
+}
+
+// integrityFingerprint turns a tool's resolved download url, checksum spec
+// and signature (public key + URL) into a short, path-safe directory name.
+func integrityFingerprint(url, checksum string, sig *Signature) string {
+	var sig_spec string
+
+	if sig != nil {
+		sig_spec = sig.PublicKey + "|" + sig.URL
+	}
+
+	sum := sha256.Sum256([]byte(url + "|" + checksum + "|" + sig_spec))
+
+	return hex.EncodeToString(sum[:])[:16]
+}
+
+// CacheHit reports whether cache_dir holds a complete, previously verified
+// install, touching its last-used marker so `cache gc`/`cache prune` know it
+// is still live.
+func CacheHit(cache_dir string) bool {
+	if _, err := os.Stat(filepath.Join(cache_dir, cacheCompleteMarker)); err != nil {
+		return false
+	}
+
+	touchCacheEntry(cache_dir)
+
+	return true
+}
+
+func touchCacheEntry(cache_dir string) {
+	marker := filepath.Join(cache_dir, cacheLastUsedMarker)
+	now := time.Now()
+
+	if err := os.Chtimes(marker, now, now); err != nil {
+		os.WriteFile(marker, nil, Permission)
+	}
+}
+
+// PopulateFromCache links cache_dir's contents into install_dir.
+func PopulateFromCache(cache_dir, install_dir string) error {
+	return linkTree(cache_dir, install_dir, map[string]bool{cacheCompleteMarker: true, cacheLastUsedMarker: true})
+}
+
+// StoreInCache links install_dir's freshly-extracted contents into
+// cache_dir and marks the entry complete, so the next install of the same
+// tool/version/os/arch is a link instead of a download.
+func StoreInCache(install_dir, cache_dir string) error {
+	if err := os.MkdirAll(cache_dir, Permission); err != nil {
+		return err
+	}
+
+	if err := linkTree(install_dir, cache_dir, nil); err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(filepath.Join(cache_dir, cacheCompleteMarker), nil, Permission); err != nil {
+		return err
+	}
+
+	touchCacheEntry(cache_dir)
+
+	return nil
+}
+
+// linkTree recreates src's file tree at dst, hard-linking regular files
+// (falling back to a copy if the cache and destination are on different
+// filesystems) and preserving symlinks and directories. Entries named in
+// skip are not copied.
+func linkTree(src, dst string, skip map[string]bool) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if skip[info.Name()] {
+			return nil
+		}
+
+		rel, err := filepath.Rel(src, path)
+
+		if err != nil {
+			return err
+		}
+
+		target := filepath.Join(dst, rel)
+
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+
+			if err != nil {
+				return err
+			}
+
+			os.Remove(target)
+
+			return os.Symlink(link, target)
+		case info.IsDir():
+			return os.MkdirAll(target, Permission)
+		default:
+			os.Remove(target)
+
+			if err := os.Link(path, target); err != nil {
+				return copyFile(path, target, info.Mode())
+			}
+
+			return nil
+		}
+	})
+}
+
+func copyFile(src, dst string, mode os.FileMode) error {
+	in, err := os.Open(src)
+
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode)
+
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	_, err = io.Copy(out, in)
+
+	return err
+}
+
+// PruneCache removes cache entries whose last-used marker is older than
+// max_age (pass 0 to evict every entry, as `cache prune` does). Entries with
+// a live lock are kept whatever their age.
+func PruneCache(max_age time.Duration) error {
+	root, err := CacheRoot()
+
+	if err != nil {
+		return err
+	}
+
+	entries, err := findCacheEntries(filepath.Join(root, "tools"))
+
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+
+		return err
+	}
+
+	now := time.Now()
+
+	for _, entry := range entries {
+		// A live lock means some process is actively installing into or
+		// reading from this entry right now; its data must survive this
+		// sweep regardless of the entry's own age.
+		if isLocked(entry) {
+			continue
+		}
+
+		marker := filepath.Join(entry, cacheLastUsedMarker)
+
+		info, err := os.Stat(marker)
+
+		if err != nil || now.Sub(info.ModTime()) > max_age {
+			fmt.Printf("Removing cached %s\n", entry)
+
+			if err := os.RemoveAll(entry); err != nil {
+				return err
+			}
+		}
+	}
+
+	return prunePartialDownloads(filepath.Join(root, "downloads"), max_age)
+}
+
+// prunePartialDownloads removes abandoned *.partial scratch files (left
+// behind when a download was interrupted hard enough that downloadArchive
+// never got to clean up after itself, e.g. the process was killed) whose
+// own mtime is older than max_age. Unlike tool cache entries, a partial
+// download has no separate last-used marker: its mtime already reflects
+// the last byte written to it.
+func prunePartialDownloads(downloads_dir string, max_age time.Duration) error {
+	entries, err := os.ReadDir(downloads_dir)
+
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+
+		return err
+	}
+
+	now := time.Now()
+
+	for _, entry := range entries {
+		// withLock manages its own ".lock" sibling's lifetime (held for an
+		// in-progress download, reclaimed itself once stale); gc must not
+		// race it by deleting a lock a live download still holds.
+		if strings.HasSuffix(entry.Name(), ".lock") {
+			continue
+		}
+
+		path := filepath.Join(downloads_dir, entry.Name())
+
+		if isLocked(path) {
+			continue
+		}
+
+		info, err := entry.Info()
+
+		if err != nil || now.Sub(info.ModTime()) > max_age {
+			fmt.Printf("Removing abandoned download %s\n", path)
+
+			if err := os.Remove(path); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// findCacheEntries walks tools_dir and returns every <checksum-fingerprint>
+// leaf directory (the actual cache entries, four levels under tools/).
+func findCacheEntries(tools_dir string) ([]string, error) {
+	var entries []string
+
+	names, err := os.ReadDir(tools_dir)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range names {
+		versions_dir := filepath.Join(tools_dir, name.Name())
+
+		versions, err := os.ReadDir(versions_dir)
+
+		if err != nil {
+			continue
+		}
+
+		for _, version := range versions {
+			version_dir := filepath.Join(versions_dir, version.Name())
+
+			variants, err := os.ReadDir(version_dir)
+
+			if err != nil {
+				continue
+			}
+
+			for _, variant := range variants {
+				variant_dir := filepath.Join(version_dir, variant.Name())
+
+				fingerprints, err := os.ReadDir(variant_dir)
+
+				if err != nil {
+					continue
+				}
+
+				for _, fingerprint := range fingerprints {
+					// Skip the ".lock" sibling withLock creates next to a
+					// fingerprint directory while an install holds it;
+					// it's not a cache entry and must not be swept by gc.
+					if !fingerprint.IsDir() {
+						continue
+					}
+
+					entries = append(entries, filepath.Join(variant_dir, fingerprint.Name()))
+				}
+			}
+		}
+	}
+
+	return entries, nil
+}
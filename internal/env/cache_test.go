@@ -0,0 +1,284 @@
+package env
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestIntegrityFingerprintChangesWithURL(t *testing.T) {
+	a := integrityFingerprint("https://example.com/a.tar.gz", "", nil)
+	b := integrityFingerprint("https://example.com/b.tar.gz", "", nil)
+
+	if a == b {
+		t.Error("integrityFingerprint produced the same fingerprint for two different urls")
+	}
+
+	if integrityFingerprint("https://example.com/a.tar.gz", "", nil) != a {
+		t.Error("integrityFingerprint is not stable across calls with the same url")
+	}
+}
+
+func TestIntegrityFingerprintChangesWithChecksum(t *testing.T) {
+	a := integrityFingerprint("https://example.com/a.tar.gz", "sha256:aaaa", nil)
+	b := integrityFingerprint("https://example.com/a.tar.gz", "sha256:bbbb", nil)
+
+	if a == b {
+		t.Error("integrityFingerprint produced the same fingerprint for two different checksums")
+	}
+
+	if integrityFingerprint("https://example.com/a.tar.gz", "sha256:aaaa", nil) != a {
+		t.Error("integrityFingerprint is not stable across calls with the same checksum")
+	}
+}
+
+func TestIntegrityFingerprintChangesWithSignature(t *testing.T) {
+	none := integrityFingerprint("https://example.com/a.tar.gz", "sha256:aaaa", nil)
+	sig1 := integrityFingerprint("https://example.com/a.tar.gz", "sha256:aaaa", &Signature{PublicKey: "key1", URL: "https://example.com/sig"})
+	sig2 := integrityFingerprint("https://example.com/a.tar.gz", "sha256:aaaa", &Signature{PublicKey: "key2", URL: "https://example.com/sig"})
+
+	if none == sig1 || sig1 == sig2 {
+		t.Error("integrityFingerprint did not change when the signature changed")
+	}
+}
+
+func TestCacheEntryDirKeysByOSArchAndFingerprint(t *testing.T) {
+	root := t.TempDir()
+
+	linux := CacheEntryDir(root, "go", "1.22.0", "linux", "amd64", "https://example.com/go.tar.gz", "sha256:aaaa", nil)
+	darwin := CacheEntryDir(root, "go", "1.22.0", "darwin", "arm64", "https://example.com/go.tar.gz", "sha256:aaaa", nil)
+
+	if linux == darwin {
+		t.Error("CacheEntryDir produced the same directory for two different os/arch pairs")
+	}
+
+	if filepath.Dir(filepath.Dir(filepath.Dir(linux))) != filepath.Join(root, "tools", "go") {
+		t.Errorf("CacheEntryDir(%q) is not nested under tools/go", linux)
+	}
+}
+
+func TestCacheEntryDirKeysByURL(t *testing.T) {
+	root := t.TempDir()
+
+	a := CacheEntryDir(root, "go", "1.22.0", "linux", "amd64", "https://example.com/a.tar.gz", "", nil)
+	b := CacheEntryDir(root, "go", "1.22.0", "linux", "amd64", "https://example.com/b.tar.gz", "", nil)
+
+	if a == b {
+		t.Error("CacheEntryDir produced the same directory for two different urls with no checksum/signature")
+	}
+}
+
+func TestStoreAndPopulateFromCacheRoundTrips(t *testing.T) {
+	install_dir := t.TempDir()
+	cache_dir := filepath.Join(t.TempDir(), "entry")
+
+	if err := os.WriteFile(filepath.Join(install_dir, "tool"), []byte("#!/bin/sh\necho hi\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.MkdirAll(filepath.Join(install_dir, "bin"), Permission); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(filepath.Join(install_dir, "bin", "helper"), []byte("helper"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := StoreInCache(install_dir, cache_dir); err != nil {
+		t.Fatalf("StoreInCache failed: %v", err)
+	}
+
+	if !CacheHit(cache_dir) {
+		t.Fatal("CacheHit returned false right after StoreInCache")
+	}
+
+	populated := t.TempDir()
+
+	if err := PopulateFromCache(cache_dir, populated); err != nil {
+		t.Fatalf("PopulateFromCache failed: %v", err)
+	}
+
+	got, err := os.ReadFile(filepath.Join(populated, "bin", "helper"))
+
+	if err != nil {
+		t.Fatalf("PopulateFromCache did not recreate bin/helper: %v", err)
+	}
+
+	if string(got) != "helper" {
+		t.Errorf("bin/helper content = %q, want %q", got, "helper")
+	}
+
+	if _, err := os.Stat(filepath.Join(populated, cacheCompleteMarker)); err == nil {
+		t.Error("PopulateFromCache copied the completeness marker into the install directory")
+	}
+}
+
+func TestCacheHitFalseWithoutCompleteMarker(t *testing.T) {
+	cache_dir := t.TempDir()
+
+	if CacheHit(cache_dir) {
+		t.Error("CacheHit returned true for a directory never marked complete")
+	}
+}
+
+func TestPruneCacheEvictsOnlyEntriesOlderThanMaxAge(t *testing.T) {
+	xdg := t.TempDir()
+	t.Setenv("XDG_CACHE_HOME", xdg)
+
+	root := filepath.Join(xdg, "toolenv")
+
+	stale := CacheEntryDir(root, "go", "1.21.0", "linux", "amd64", "https://example.com/go.tar.gz", "sha256:aaaa", nil)
+	fresh := CacheEntryDir(root, "go", "1.22.0", "linux", "amd64", "https://example.com/go.tar.gz", "sha256:bbbb", nil)
+
+	for _, dir := range []string{stale, fresh} {
+		if err := os.MkdirAll(dir, Permission); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.WriteFile(filepath.Join(dir, cacheLastUsedMarker), nil, Permission); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	old := time.Now().Add(-48 * time.Hour)
+
+	if err := os.Chtimes(filepath.Join(stale, cacheLastUsedMarker), old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := PruneCache(24 * time.Hour); err != nil {
+		t.Fatalf("PruneCache failed: %v", err)
+	}
+
+	if _, err := os.Stat(stale); err == nil {
+		t.Error("PruneCache did not evict an entry older than max_age")
+	}
+
+	if _, err := os.Stat(fresh); err != nil {
+		t.Error("PruneCache evicted an entry within max_age")
+	}
+}
+
+func TestPruneCacheLeavesLockFilesAlone(t *testing.T) {
+	xdg := t.TempDir()
+	t.Setenv("XDG_CACHE_HOME", xdg)
+
+	root := filepath.Join(xdg, "toolenv")
+
+	entry := CacheEntryDir(root, "go", "1.22.0", "linux", "amd64", "https://example.com/go.tar.gz", "sha256:aaaa", nil)
+
+	if err := os.MkdirAll(entry, Permission); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(filepath.Join(entry, cacheLastUsedMarker), nil, Permission); err != nil {
+		t.Fatal(err)
+	}
+
+	// A ".lock" sibling, as withLock creates while an install holds it,
+	// sits next to the fingerprint directory and has no last-used marker
+	// of its own - PruneCache must not treat it as an entry to evict.
+	lock_path := entry + ".lock"
+
+	if err := os.WriteFile(lock_path, nil, Permission); err != nil {
+		t.Fatal(err)
+	}
+
+	old := time.Now().Add(-48 * time.Hour)
+
+	if err := os.Chtimes(lock_path, old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := PruneCache(24 * time.Hour); err != nil {
+		t.Fatalf("PruneCache failed: %v", err)
+	}
+
+	if _, err := os.Stat(lock_path); err != nil {
+		t.Error("PruneCache removed a lock file sitting alongside a cache entry")
+	}
+
+	downloads_lock := filepath.Join(root, "downloads", "abc123.partial.lock")
+
+	if err := os.MkdirAll(filepath.Dir(downloads_lock), Permission); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(downloads_lock, nil, Permission); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Chtimes(downloads_lock, old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := PruneCache(24 * time.Hour); err != nil {
+		t.Fatalf("PruneCache failed: %v", err)
+	}
+
+	if _, err := os.Stat(downloads_lock); err != nil {
+		t.Error("PruneCache removed a download lock file")
+	}
+}
+
+func TestPruneCacheLeavesLockedEntryAndDownloadAlone(t *testing.T) {
+	xdg := t.TempDir()
+	t.Setenv("XDG_CACHE_HOME", xdg)
+
+	root := filepath.Join(xdg, "toolenv")
+
+	entry := CacheEntryDir(root, "go", "1.22.0", "linux", "amd64", "https://example.com/go.tar.gz", "sha256:aaaa", nil)
+
+	if err := os.MkdirAll(entry, Permission); err != nil {
+		t.Fatal(err)
+	}
+
+	old := time.Now().Add(-48 * time.Hour)
+
+	if err := os.WriteFile(filepath.Join(entry, cacheLastUsedMarker), nil, Permission); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Chtimes(filepath.Join(entry, cacheLastUsedMarker), old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	// A live (fresh) lock next to an entry means some process is actively
+	// installing into or reading from it right now; PruneCache must not
+	// evict the entry's data out from under that process just because its
+	// own last-used marker looks old.
+	if err := os.WriteFile(entry+".lock", nil, Permission); err != nil {
+		t.Fatal(err)
+	}
+
+	partial := filepath.Join(root, "downloads", "abc123.partial")
+
+	if err := os.MkdirAll(filepath.Dir(partial), Permission); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(partial, nil, Permission); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Chtimes(partial, old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(partial+".lock", nil, Permission); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := PruneCache(24 * time.Hour); err != nil {
+		t.Fatalf("PruneCache failed: %v", err)
+	}
+
+	if _, err := os.Stat(entry); err != nil {
+		t.Error("PruneCache evicted a cache entry that had a live lock")
+	}
+
+	if _, err := os.Stat(partial); err != nil {
+		t.Error("PruneCache removed a partial download that had a live lock")
+	}
+}
@@ -0,0 +1,208 @@
+package env
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// verifyChecksum checks filename against spec, which is either
+// "<algo>:<hex digest>" or "<algo>:<url or url template>" pointing at a
+// GNU-coreutils-style "<hex>  <filename>" sums file. artifact_name is the
+// name the real sums file lists the artifact under (the tool's download
+// URL basename) — it is unrelated to filename, which is wherever the
+// archive happens to be staged on disk (a cache scratch path, not the
+// upstream artifact name). os_name/arch/version are threaded through so the
+// sums file URL can itself use the {{.version}} / {{.os}} / {{.arch}}
+// templating that buildURL supports for tool URLs.
+func verifyChecksum(spec, filename, artifact_name, version, os_name, arch string) error {
+	algo, rest, ok := strings.Cut(spec, ":")
+
+	if !ok {
+		return fmt.Errorf("invalid checksum spec %q: expected \"<algo>:<digest-or-url>\"", spec)
+	}
+
+	var want string
+
+	if strings.HasPrefix(rest, "http://") || strings.HasPrefix(rest, "https://") {
+		sums_url, err := BuildURL(rest, version, os_name, arch)
+
+		if err != nil {
+			return fmt.Errorf("failed to build checksum URL: %w", err)
+		}
+
+		want, err = fetchDigestFromSumsFile(sums_url, artifact_name)
+
+		if err != nil {
+			return err
+		}
+	} else {
+		want = rest
+	}
+
+	got, err := hashFile(algo, filename)
+
+	if err != nil {
+		return err
+	}
+
+	if !strings.EqualFold(got, want) {
+		return fmt.Errorf("checksum mismatch: expected %s, got %s", want, got)
+	}
+
+	return nil
+}
+
+// artifactNameFromURL returns the filename a download URL's own sums file
+// would list it under: the URL's last path segment, with any query string
+// or fragment stripped first.
+func artifactNameFromURL(url string) string {
+	if idx := strings.IndexAny(url, "?#"); idx != -1 {
+		url = url[:idx]
+	}
+
+	if idx := strings.LastIndex(url, "/"); idx != -1 {
+		return url[idx+1:]
+	}
+
+	return url
+}
+
+func hashFile(algo, filename string) (string, error) {
+	var h hash.Hash
+
+	switch strings.ToLower(algo) {
+	case "sha256":
+		h = sha256.New()
+	case "sha1":
+		h = sha1.New()
+	case "sha512":
+		h = sha512.New()
+	default:
+		return "", fmt.Errorf("unsupported checksum algorithm %q", algo)
+	}
+
+	f, err := os.Open(filename)
+
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// fetchDigestFromSumsFile downloads a SHA256SUMS-style file and returns the
+// digest for the line whose filename matches want.
+func fetchDigestFromSumsFile(sums_url, want string) (string, error) {
+	response, err := http.Get(sums_url)
+
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch checksum file: %w", err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != 200 {
+		return "", fmt.Errorf("failed to fetch checksum file: %s", response.Status)
+	}
+
+	scanner := bufio.NewScanner(response.Body)
+
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+
+		if len(fields) != 2 {
+			continue
+		}
+
+		digest, name := fields[0], strings.TrimPrefix(fields[1], "*")
+
+		if name == want {
+			return digest, nil
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+
+	return "", fmt.Errorf("no checksum entry for %q in %s", want, sums_url)
+}
+
+// verifySignature checks a detached minisign signature for filename against
+// a public key, both identified by sig. Verification is delegated to the
+// minisign CLI rather than a Go-native implementation.
+//
+// Known limitation: unlike the rest of this package (native archive
+// extraction, native checksum hashing), this shells out to a "minisign"
+// binary that must already be on PATH. It is not bundled with toolenv and
+// has no official Windows build, so any tool configured with a Signature
+// currently cannot be installed on Windows. Tracked for a future native
+// replacement (e.g. a Go minisign-verification library); until then,
+// Windows users should rely on Checksum instead of Signature.
+func verifySignature(sig *Signature, filename, version, os_name, arch string) error {
+	sig_url, err := BuildURL(sig.URL, version, os_name, arch)
+
+	if err != nil {
+		return fmt.Errorf("failed to build signature URL: %w", err)
+	}
+
+	sig_file, err := downloadToTemp(sig_url)
+
+	if err != nil {
+		return fmt.Errorf("failed to download signature: %w", err)
+	}
+	defer os.Remove(sig_file)
+
+	return runMinisignVerify(sig.PublicKey, sig_file, filename)
+}
+
+func downloadToTemp(url string) (string, error) {
+	response, err := http.Get(url)
+
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != 200 {
+		return "", fmt.Errorf("failed to download file: %s", response.Status)
+	}
+
+	tmp_file, err := os.CreateTemp("", "toolenv-sig-*")
+
+	if err != nil {
+		return "", err
+	}
+	defer tmp_file.Close()
+
+	if _, err := io.Copy(tmp_file, response.Body); err != nil {
+		return "", err
+	}
+
+	return tmp_file.Name(), nil
+}
+
+func runMinisignVerify(public_key, sig_file, filename string) error {
+	if _, err := exec.LookPath("minisign"); err != nil {
+		return fmt.Errorf("signature verification requires the \"minisign\" CLI on PATH (not bundled with toolenv, and has no official Windows build): %w", err)
+	}
+
+	cmd := exec.Command("minisign", "-V", "-P", public_key, "-x", sig_file, "-m", filename)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
@@ -0,0 +1,119 @@
+package env
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeTempFile(t *testing.T, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "artifact.tar.gz")
+
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestVerifyChecksumDirectDigest(t *testing.T) {
+	path := writeTempFile(t, "hello toolenv")
+
+	sum := sha256.Sum256([]byte("hello toolenv"))
+	digest := hex.EncodeToString(sum[:])
+
+	if err := verifyChecksum("sha256:"+digest, path, "artifact.tar.gz", "", "", ""); err != nil {
+		t.Errorf("verifyChecksum rejected a matching digest: %v", err)
+	}
+
+	if err := verifyChecksum("sha256:"+"0000000000000000000000000000000000000000000000000000000000000000", path, "artifact.tar.gz", "", "", ""); err == nil {
+		t.Error("verifyChecksum accepted a mismatched digest")
+	}
+}
+
+func TestVerifyChecksumInvalidSpec(t *testing.T) {
+	path := writeTempFile(t, "hello toolenv")
+
+	if err := verifyChecksum("no-colon-here", path, "artifact.tar.gz", "", "", ""); err == nil {
+		t.Error("verifyChecksum accepted a spec with no \"<algo>:\" prefix")
+	}
+
+	if err := verifyChecksum("md5:deadbeef", path, "artifact.tar.gz", "", "", ""); err == nil {
+		t.Error("verifyChecksum accepted an unsupported algorithm")
+	}
+}
+
+// TestVerifyChecksumSumsFileLooksUpByArtifactName pins down that the sums
+// file is queried by the tool's real download name, not by the basename of
+// wherever the archive happens to be staged on disk (a cache scratch path
+// like <sha>.partial never appears in a real SHA256SUMS file).
+func TestVerifyChecksumSumsFileLooksUpByArtifactName(t *testing.T) {
+	content := "hello toolenv"
+	path := writeTempFile(t, content)
+
+	sum := sha256.Sum256([]byte(content))
+	digest := hex.EncodeToString(sum[:])
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s  tool-1.2.3.linux-amd64.tar.gz\n", digest)
+	}))
+	defer server.Close()
+
+	err := verifyChecksum("sha256:"+server.URL, path, "tool-1.2.3.linux-amd64.tar.gz", "", "", "")
+
+	if err != nil {
+		t.Errorf("verifyChecksum failed to match the sums-file entry by artifact name: %v", err)
+	}
+
+	if err := verifyChecksum("sha256:"+server.URL, path, filepath.Base(path), "", "", ""); err == nil {
+		t.Error("verifyChecksum matched using the on-disk scratch filename instead of the artifact name")
+	}
+}
+
+func TestArtifactNameFromURL(t *testing.T) {
+	cases := []struct {
+		url  string
+		want string
+	}{
+		{"https://go.dev/dl/go1.22.0.linux-amd64.tar.gz", "go1.22.0.linux-amd64.tar.gz"},
+		{"https://example.com/download?file=tool.zip", "download"},
+		{"https://example.com/releases/tool.tar.gz#checksum", "tool.tar.gz"},
+	}
+
+	for _, c := range cases {
+		if got := artifactNameFromURL(c.url); got != c.want {
+			t.Errorf("artifactNameFromURL(%q) = %q, want %q", c.url, got, c.want)
+		}
+	}
+}
+
+func TestFetchDigestFromSumsFile(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa  other.tar.gz\n" +
+			"bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb *tool.tar.gz\n"))
+	}))
+	defer server.Close()
+
+	digest, err := fetchDigestFromSumsFile(server.URL, "tool.tar.gz")
+
+	if err != nil {
+		t.Fatalf("fetchDigestFromSumsFile returned an error: %v", err)
+	}
+
+	want := "bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"
+
+	if digest != want {
+		t.Errorf("fetchDigestFromSumsFile = %q, want %q", digest, want)
+	}
+
+	if _, err := fetchDigestFromSumsFile(server.URL, "missing.tar.gz"); err == nil {
+		t.Error("fetchDigestFromSumsFile did not error for a filename absent from the sums file")
+	}
+}
@@ -0,0 +1,117 @@
+// Package env holds the pieces of toolenv that know how to read a
+// toolenv.yml, resolve and install the tools it lists, and write the
+// activation scripts for an environment. It exists so the CLI subcommands
+// in package main can share one implementation instead of each re-deriving
+// it from main's original single Action.
+package env
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"runtime"
+	"text/template"
+
+	"gopkg.in/yaml.v3"
+)
+
+const Permission os.FileMode = 0755
+
+// Version is toolenv's own release version, reported by `toolenv --version`
+// and sent as the User-Agent on tool downloads.
+const Version = "0.1.0"
+
+type Config struct {
+	Tools []Tool `yaml:"tools"`
+}
+
+type Tool struct {
+	Name          string             `yaml:"name"`
+	Version       string             `yaml:"version"`
+	URL           string             `yaml:"url"`
+	Checksum      string             `yaml:"checksum,omitempty"`
+	Signature     *Signature         `yaml:"signature,omitempty"`
+	Env           map[string]string  `yaml:"env,omitempty"`
+	Normalization *ToolNormalization `yaml:"normalization,omitempty"`
+}
+
+type ToolNormalization struct {
+	Arch map[string]string `yaml:"arch"`
+	OS   map[string]string `yaml:"os"`
+}
+
+// Signature names a minisign detached signature and the public key that
+// should verify it.
+type Signature struct {
+	PublicKey string `yaml:"public_key"`
+	URL       string `yaml:"url"`
+}
+
+// LoadConfig reads and parses a toolenv.yml from path.
+func LoadConfig(path string) (*Config, error) {
+	f, err := os.Open(path)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	defer f.Close()
+
+	var data Config
+
+	if err := yaml.NewDecoder(f).Decode(&data); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+
+	return &data, nil
+}
+
+// SaveConfig writes cfg back to path, used by `toolenv add`/`toolenv remove`
+// to persist edits.
+func SaveConfig(path string, cfg *Config) error {
+	out, err := yaml.Marshal(cfg)
+
+	if err != nil {
+		return fmt.Errorf("failed to encode %s: %w", path, err)
+	}
+
+	return os.WriteFile(path, out, 0644)
+}
+
+func NormalizeSystem(spec *ToolNormalization) (string, string) {
+	arch := runtime.GOARCH
+	os_name := runtime.GOOS
+
+	if spec != nil {
+		if mapped_arch, ok := spec.Arch[arch]; ok {
+			arch = mapped_arch
+		}
+
+		if mapped_os, ok := spec.OS[os_name]; ok {
+			os_name = mapped_os
+		}
+	}
+
+	return os_name, arch
+}
+
+func BuildURL(template_string, version, os_name, arch string) (string, error) {
+	tmpl, err := template.New("url").Parse(template_string)
+
+	if err != nil {
+		return "", err
+	}
+
+	data := map[string]string{
+		"version": version,
+		"os":      os_name,
+		"arch":    arch,
+	}
+
+	var buf bytes.Buffer
+
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", err
+	}
+
+	return buf.String(), nil
+}
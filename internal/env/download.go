@@ -0,0 +1,293 @@
+package env
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/schollz/progressbar/v3"
+)
+
+const (
+	// downloadIdleTimeout is how long a download may go without receiving
+	// any bytes before it is treated as stalled. It bounds the connection
+	// and each read, not the transfer as a whole, so a large archive that
+	// keeps making progress on a slow link is never killed outright -
+	// only a connection that stops responding is.
+	downloadIdleTimeout = 60 * time.Second
+	downloadMaxAttempts = 5
+	downloadBaseBackoff = 500 * time.Millisecond
+)
+
+// downloadIdleTimeoutEnv overrides downloadIdleTimeout, parsed as a
+// time.Duration string (e.g. "2m"), for networks where 60s of silence is
+// normal rather than stalled.
+const downloadIdleTimeoutEnv = "TOOLENV_DOWNLOAD_IDLE_TIMEOUT"
+
+// idleTimeout resolves the configured idle timeout: downloadIdleTimeoutEnv
+// when set and valid, otherwise downloadIdleTimeout.
+func idleTimeout() time.Duration {
+	if value := os.Getenv(downloadIdleTimeoutEnv); value != "" {
+		if parsed, err := time.ParseDuration(value); err == nil {
+			return parsed
+		}
+	}
+
+	return downloadIdleTimeout
+}
+
+var downloadUserAgent = "toolenv/" + Version
+
+// retryableError marks a download failure worth retrying (a network error,
+// a 5xx, or a 429), as opposed to one downloadArchive should give up on
+// immediately, such as a 404.
+type retryableError struct {
+	err        error
+	retryAfter time.Duration
+}
+
+func (r *retryableError) Error() string { return r.err.Error() }
+func (r *retryableError) Unwrap() error { return r.err }
+
+// downloadArchive fetches url with retry, HTTP range resume and a progress
+// bar, and returns the path to the completed file. The file lives under the
+// shared cache's downloads/ directory, named from a hash of url rather than
+// a random temp name, so an install interrupted mid-download resumes
+// instead of starting over on the next attempt.
+//
+// silent suppresses the progress bar's animation. Pass true when more than
+// one download may run at once: concurrent bars share os.Stderr with no
+// coordination between their carriage-return redraws, so rendering more
+// than one at a time garbles the terminal.
+//
+// The whole attempt loop runs under a lock on dest, so two toolenv
+// processes downloading the same url at once (e.g. parallel CI jobs
+// sharing the cache) take turns writing it instead of interleaving.
+func downloadArchive(url string, silent bool) (string, error) {
+	dest, err := downloadCachePath(url)
+
+	if err != nil {
+		return "", err
+	}
+
+	client := &http.Client{Transport: &http.Transport{ResponseHeaderTimeout: idleTimeout()}}
+
+	err = withLock(dest, func() error {
+		var lastErr error
+
+		for attempt := 1; attempt <= downloadMaxAttempts; attempt++ {
+			if attempt > 1 {
+				wait := downloadBackoff(attempt, lastErr)
+
+				fmt.Printf("|- retrying download (attempt %d/%d) in %s: %s\n", attempt, downloadMaxAttempts, wait, lastErr)
+
+				time.Sleep(wait)
+			}
+
+			err := downloadAttempt(client, url, dest, silent)
+
+			if err == nil {
+				return nil
+			}
+
+			var retryable *retryableError
+
+			if !errors.As(err, &retryable) {
+				os.Remove(dest)
+
+				return err
+			}
+
+			lastErr = err
+		}
+
+		os.Remove(dest)
+
+		return fmt.Errorf("giving up after %d attempts: %w", downloadMaxAttempts, lastErr)
+	})
+
+	if err != nil {
+		return "", err
+	}
+
+	return dest, nil
+}
+
+// downloadAttempt performs one GET, resuming from whatever dest already
+// holds from a prior attempt via a Range header, and streams the response
+// body into dest through a progress bar. silent renders the bar to
+// io.Discard instead of os.Stderr; see downloadArchive.
+func downloadAttempt(client *http.Client, url, dest string, silent bool) error {
+	var resume int64
+
+	if info, err := os.Stat(dest); err == nil {
+		resume = info.Size()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+
+	if err != nil {
+		return err
+	}
+
+	request.Header.Set("User-Agent", downloadUserAgent)
+
+	if resume > 0 {
+		request.Header.Set("Range", fmt.Sprintf("bytes=%d-", resume))
+	}
+
+	response, err := client.Do(request)
+
+	if err != nil {
+		return &retryableError{err: err}
+	}
+
+	defer response.Body.Close()
+
+	switch response.StatusCode {
+	case http.StatusOK:
+		resume = 0 // server ignored our Range header and sent the whole file
+	case http.StatusPartialContent:
+		// resuming as requested
+	case http.StatusRequestedRangeNotSatisfiable:
+		// our partial file is already complete, or stale; restart clean
+		os.Remove(dest)
+
+		return &retryableError{err: fmt.Errorf("download: range not satisfiable")}
+	case http.StatusTooManyRequests:
+		return &retryableError{
+			err:        fmt.Errorf("download: %s", response.Status),
+			retryAfter: parseRetryAfter(response.Header.Get("Retry-After")),
+		}
+	default:
+		if response.StatusCode >= 500 {
+			return &retryableError{err: fmt.Errorf("download: %s", response.Status)}
+		}
+
+		return fmt.Errorf("download: %s", response.Status)
+	}
+
+	flags := os.O_CREATE | os.O_WRONLY
+
+	if resume > 0 {
+		flags |= os.O_APPEND
+	} else {
+		flags |= os.O_TRUNC
+	}
+
+	file, err := os.OpenFile(dest, flags, Permission)
+
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	var bar *progressbar.ProgressBar
+
+	if silent {
+		bar = progressbar.DefaultBytesSilent(resume+response.ContentLength, "downloading")
+	} else {
+		bar = progressbar.DefaultBytes(resume+response.ContentLength, "downloading")
+	}
+
+	if resume > 0 {
+		bar.Add64(resume)
+	}
+
+	body := newIdleTimeoutReader(response.Body, idleTimeout(), cancel)
+
+	if _, err := io.Copy(file, io.TeeReader(body, bar)); err != nil {
+		if ctx.Err() != nil {
+			return &retryableError{err: fmt.Errorf("download: stalled for longer than %s", idleTimeout())}
+		}
+
+		return &retryableError{err: err}
+	}
+
+	return nil
+}
+
+// idleTimeoutReader wraps a response body so a download is only ever
+// bounded by gaps in the byte stream, not by its overall size: every Read
+// that returns data pushes the deadline back out, so a large-but-progressing
+// transfer over a slow link runs as long as it needs to, while a connection
+// that genuinely stops responding is cancelled instead of hanging forever.
+type idleTimeoutReader struct {
+	r       io.Reader
+	timeout time.Duration
+	timer   *time.Timer
+}
+
+func newIdleTimeoutReader(r io.Reader, timeout time.Duration, cancel context.CancelFunc) *idleTimeoutReader {
+	return &idleTimeoutReader{r: r, timeout: timeout, timer: time.AfterFunc(timeout, cancel)}
+}
+
+func (r *idleTimeoutReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+
+	r.timer.Reset(r.timeout)
+
+	return n, err
+}
+
+// downloadBackoff returns how long to wait before the next attempt:
+// Retry-After when the server gave one (as 429s do), otherwise exponential
+// backoff with jitter.
+func downloadBackoff(attempt int, err error) time.Duration {
+	var retryable *retryableError
+
+	if errors.As(err, &retryable) && retryable.retryAfter > 0 {
+		return retryable.retryAfter
+	}
+
+	backoff := downloadBaseBackoff * time.Duration(int64(1)<<uint(attempt-1))
+	jitter := time.Duration(rand.Int63n(int64(backoff)/2 + 1))
+
+	return backoff + jitter
+}
+
+// parseRetryAfter parses a Retry-After header. Only the common
+// delay-in-seconds form is supported; the less common HTTP-date form falls
+// back to the caller's own backoff.
+func parseRetryAfter(value string) time.Duration {
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+
+	return 0
+}
+
+// downloadCachePath returns the scratch file a download of url resumes
+// from: a name derived from url's hash, under the shared cache's
+// downloads/ directory, so it survives across separate `toolenv install`
+// invocations.
+func downloadCachePath(url string) (string, error) {
+	root, err := CacheRoot()
+
+	if err != nil {
+		return "", err
+	}
+
+	dir := filepath.Join(root, "downloads")
+
+	if err := os.MkdirAll(dir, Permission); err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256([]byte(url))
+
+	return filepath.Join(dir, hex.EncodeToString(sum[:])+".partial"), nil
+}
@@ -0,0 +1,246 @@
+package env
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDownloadBackoffUsesRetryAfterWhenPresent(t *testing.T) {
+	err := &retryableError{err: errors.New("429"), retryAfter: 3 * time.Second}
+
+	if got := downloadBackoff(1, err); got != 3*time.Second {
+		t.Errorf("downloadBackoff = %s, want %s", got, 3*time.Second)
+	}
+}
+
+func TestDownloadBackoffGrowsExponentiallyWithoutRetryAfter(t *testing.T) {
+	err := &retryableError{err: errors.New("network error")}
+
+	first := downloadBackoff(1, err)
+	second := downloadBackoff(2, err)
+
+	if second < downloadBaseBackoff*2 {
+		t.Errorf("downloadBackoff(2, ...) = %s, want at least %s", second, downloadBaseBackoff*2)
+	}
+
+	if first > downloadBaseBackoff*2 {
+		t.Errorf("downloadBackoff(1, ...) = %s, want at most %s", first, downloadBaseBackoff*2)
+	}
+}
+
+func TestParseRetryAfterSeconds(t *testing.T) {
+	if got := parseRetryAfter("5"); got != 5*time.Second {
+		t.Errorf("parseRetryAfter(\"5\") = %s, want %s", got, 5*time.Second)
+	}
+}
+
+func TestParseRetryAfterUnsupportedFormFallsBackToZero(t *testing.T) {
+	if got := parseRetryAfter("Wed, 21 Oct 2015 07:28:00 GMT"); got != 0 {
+		t.Errorf("parseRetryAfter(HTTP-date) = %s, want 0", got)
+	}
+}
+
+func TestDownloadAttemptResumesFromExistingPartialFile(t *testing.T) {
+	const full = "hello toolenv, this is the full archive body"
+	const already = "hello toolenv, "
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rang := r.Header.Get("Range")
+
+		if rang == "" {
+			t.Errorf("request had no Range header; want bytes=%d-", len(already))
+			http.Error(w, "expected a Range header", http.StatusBadRequest)
+			return
+		}
+
+		if rang != fmt.Sprintf("bytes=%d-", len(already)) {
+			t.Errorf("Range header = %q, want %q", rang, fmt.Sprintf("bytes=%d-", len(already)))
+		}
+
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", len(already), len(full)-1, len(full)))
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write([]byte(full[len(already):]))
+	}))
+	defer server.Close()
+
+	dest := filepath.Join(t.TempDir(), "archive.partial")
+
+	if err := os.WriteFile(dest, []byte(already), Permission); err != nil {
+		t.Fatal(err)
+	}
+
+	client := &http.Client{}
+
+	if err := downloadAttempt(client, server.URL, dest, false); err != nil {
+		t.Fatalf("downloadAttempt failed to resume: %v", err)
+	}
+
+	got, err := os.ReadFile(dest)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(got) != full {
+		t.Errorf("resumed download = %q, want %q", got, full)
+	}
+}
+
+func TestDownloadAttemptSilentStillDownloads(t *testing.T) {
+	const full = "the whole archive, downloaded with a silenced progress bar"
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(full))
+	}))
+	defer server.Close()
+
+	dest := filepath.Join(t.TempDir(), "archive")
+	client := &http.Client{}
+
+	if err := downloadAttempt(client, server.URL, dest, true); err != nil {
+		t.Fatalf("downloadAttempt failed: %v", err)
+	}
+
+	got, err := os.ReadFile(dest)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(got) != full {
+		t.Errorf("silent download = %q, want %q", got, full)
+	}
+}
+
+func TestDownloadAttemptRestartsWhenServerIgnoresRange(t *testing.T) {
+	const full = "the whole archive, served fresh"
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK) // server ignores our Range header
+		w.Write([]byte(full))
+	}))
+	defer server.Close()
+
+	dest := filepath.Join(t.TempDir(), "archive.partial")
+
+	if err := os.WriteFile(dest, []byte("stale partial content"), Permission); err != nil {
+		t.Fatal(err)
+	}
+
+	client := &http.Client{}
+
+	if err := downloadAttempt(client, server.URL, dest, false); err != nil {
+		t.Fatalf("downloadAttempt failed: %v", err)
+	}
+
+	got, err := os.ReadFile(dest)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(got) != full {
+		t.Errorf("restarted download = %q, want %q", got, full)
+	}
+}
+
+func TestDownloadAttemptRetryableOn5xxAndTooManyRequests(t *testing.T) {
+	cases := []int{http.StatusInternalServerError, http.StatusBadGateway, http.StatusTooManyRequests}
+
+	for _, status := range cases {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(status)
+		}))
+
+		dest := filepath.Join(t.TempDir(), "archive.partial")
+		client := &http.Client{}
+
+		err := downloadAttempt(client, server.URL, dest, false)
+		server.Close()
+
+		var retryable *retryableError
+
+		if !errors.As(err, &retryable) {
+			t.Errorf("status %d: downloadAttempt returned %v, want a *retryableError", status, err)
+		}
+	}
+}
+
+func TestDownloadAttemptNotRetryableOn404(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	dest := filepath.Join(t.TempDir(), "archive.partial")
+	client := &http.Client{}
+
+	err := downloadAttempt(client, server.URL, dest, false)
+
+	var retryable *retryableError
+
+	if errors.As(err, &retryable) {
+		t.Error("downloadAttempt treated a 404 as retryable")
+	}
+
+	if err == nil {
+		t.Error("downloadAttempt did not error on a 404")
+	}
+}
+
+// TestIdleTimeoutReaderCancelsOnStall pins down that a connection making no
+// progress gets cancelled, rather than hanging for the life of the request:
+// the deadline only ever has to survive the gap between two reads, not the
+// transfer as a whole.
+func TestIdleTimeoutReaderCancelsOnStall(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("first chunk"))
+
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+
+		time.Sleep(200 * time.Millisecond) // longer than the test's idle timeout, never resumes
+	}))
+	defer server.Close()
+
+	t.Setenv(downloadIdleTimeoutEnv, "20ms")
+
+	dest := filepath.Join(t.TempDir(), "archive.partial")
+	client := &http.Client{}
+
+	err := downloadAttempt(client, server.URL, dest, false)
+
+	var retryable *retryableError
+
+	if !errors.As(err, &retryable) {
+		t.Fatalf("downloadAttempt returned %v, want a *retryableError from the stalled connection", err)
+	}
+}
+
+func TestIdleTimeoutDefaultsWhenEnvUnsetOrInvalid(t *testing.T) {
+	t.Setenv(downloadIdleTimeoutEnv, "")
+
+	if got := idleTimeout(); got != downloadIdleTimeout {
+		t.Errorf("idleTimeout() = %s, want default %s", got, downloadIdleTimeout)
+	}
+
+	t.Setenv(downloadIdleTimeoutEnv, "not-a-duration")
+
+	if got := idleTimeout(); got != downloadIdleTimeout {
+		t.Errorf("idleTimeout() with an invalid override = %s, want default %s", got, downloadIdleTimeout)
+	}
+
+	t.Setenv(downloadIdleTimeoutEnv, "2m")
+
+	if got := idleTimeout(); got != 2*time.Minute {
+		t.Errorf("idleTimeout() = %s, want %s", got, 2*time.Minute)
+	}
+}
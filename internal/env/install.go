@@ -0,0 +1,99 @@
+package env
+
+import (
+	"fmt"
+	"os"
+)
+
+// Install resolves tool's download URL, satisfies it from the shared cache
+// when possible, and otherwise downloads, verifies and extracts it into
+// install_dir. It reports whether the result came from the cache.
+//
+// concurrent silences the download's progress bar; pass true when Install
+// may be called for several tools at once, so their bars don't garble each
+// other's output on a shared stderr.
+func Install(tool Tool, install_dir string, no_cache, concurrent bool) (bool, error) {
+	os_name, arch := NormalizeSystem(tool.Normalization)
+
+	url, err := BuildURL(tool.URL, tool.Version, os_name, arch)
+
+	if err != nil {
+		return false, fmt.Errorf("failed to build the tool URL: %w", err)
+	}
+
+	var cache_dir string
+
+	if !no_cache {
+		if root, err := CacheRoot(); err == nil {
+			cache_dir = CacheEntryDir(root, tool.Name, tool.Version, os_name, arch, url, tool.Checksum, tool.Signature)
+		}
+	}
+
+	if cache_dir == "" {
+		return false, installTool(tool, url, install_dir, os_name, arch, concurrent)
+	}
+
+	var cached bool
+
+	// The whole check-then-populate-or-store sequence runs under a lock on
+	// cache_dir, so two toolenv processes racing on the same tool (e.g.
+	// parallel CI jobs sharing $XDG_CACHE_HOME) take turns instead of one
+	// stomping the other's half-populated entry mid-install.
+	err = withLock(cache_dir, func() error {
+		if CacheHit(cache_dir) {
+			cached = true
+
+			return PopulateFromCache(cache_dir, install_dir)
+		}
+
+		if err := installTool(tool, url, install_dir, os_name, arch, concurrent); err != nil {
+			return err
+		}
+
+		if err := StoreInCache(install_dir, cache_dir); err != nil {
+			return fmt.Errorf("failed to populate cache: %w", err)
+		}
+
+		return nil
+	})
+
+	return cached, err
+}
+
+// installTool downloads url, verifies it against tool's checksum/signature
+// (if any), and extracts it into install_dir.
+func installTool(tool Tool, url, install_dir, os_name, arch string, concurrent bool) error {
+	fmt.Printf("|- Downloading from \"%s\"\n", url)
+
+	downloaded_file, err := downloadArchive(url, concurrent)
+
+	if err != nil {
+		return fmt.Errorf("failed to download file: %w", err)
+	}
+
+	defer os.Remove(downloaded_file)
+
+	if tool.Checksum != "" {
+		if err := verifyChecksum(tool.Checksum, downloaded_file, artifactNameFromURL(url), tool.Version, os_name, arch); err != nil {
+			return err
+		}
+
+		fmt.Printf("|- Checksum verified\n")
+	}
+
+	if tool.Signature != nil {
+		if err := verifySignature(tool.Signature, downloaded_file, tool.Version, os_name, arch); err != nil {
+			return err
+		}
+
+		fmt.Printf("|- Signature verified\n")
+	}
+
+	format, err := detectArchiveFormat(url, downloaded_file)
+
+	if err != nil {
+		return err
+	}
+
+	return extractArchive(format, downloaded_file, install_dir)
+}
@@ -0,0 +1,115 @@
+package env
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// lockStaleAge and lockPollWait are vars rather than consts so tests can
+// shrink them instead of waiting out a real 10-minute window. The heartbeat
+// interval has no var of its own: heartbeatLock derives it from lockStaleAge.
+var (
+	// lockStaleAge is how old a lock file can get before it's assumed to
+	// belong to a process that crashed or was killed mid-install, rather
+	// than one still working, and is reclaimed instead of waited on. There
+	// is no separate cap on how long a waiter sits for a live holder: the
+	// work done under the lock (a download, possibly of a large archive
+	// over a slow link) has no fixed upper bound either, so the only thing
+	// that should end the wait is the lock being released or going stale.
+	lockStaleAge = 10 * time.Minute
+	lockPollWait = 100 * time.Millisecond
+)
+
+// withLock runs fn while holding an exclusive, cross-process lock on
+// path+".lock". It guards the shared cache (the download scratch file and
+// a tool's cache entry directory) against two toolenv processes - e.g.
+// parallel CI jobs sharing $XDG_CACHE_HOME - racing on the same path and
+// interleaving writes into it. The lock is a plain marker file created
+// with O_EXCL rather than flock(2), so acquiring and releasing it behaves
+// the same on every platform this repo targets. While fn runs, the lock
+// file's mtime is refreshed on a timer so a holder still actively working
+// past lockStaleAge isn't mistaken for one that crashed and reclaimed out
+// from under it; only a lock whose holder has stopped renewing it goes
+// stale.
+func withLock(path string, fn func() error) error {
+	lock_path := path + ".lock"
+
+	if err := os.MkdirAll(filepath.Dir(lock_path), Permission); err != nil {
+		return err
+	}
+
+	for {
+		file, err := os.OpenFile(lock_path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, Permission)
+
+		if err == nil {
+			file.Close()
+
+			break
+		}
+
+		if !os.IsExist(err) {
+			return fmt.Errorf("failed to acquire lock on %s: %w", path, err)
+		}
+
+		if info, statErr := os.Stat(lock_path); statErr == nil && time.Since(info.ModTime()) > lockStaleAge {
+			os.Remove(lock_path)
+
+			continue
+		}
+
+		time.Sleep(lockPollWait)
+	}
+
+	defer os.Remove(lock_path)
+
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+
+	go heartbeatLock(lock_path, stop, stopped)
+
+	defer func() {
+		close(stop)
+		<-stopped
+	}()
+
+	return fn()
+}
+
+// heartbeatLock periodically touches lock_path's mtime until stop is
+// closed, so withLock's staleness check never reclaims a lock whose holder
+// is still running fn. It closes stopped just before returning so withLock
+// can wait for it to fully exit - and stop touching lock_path - before the
+// lock is removed and the path potentially reacquired by someone else.
+func heartbeatLock(lock_path string, stop <-chan struct{}, stopped chan<- struct{}) {
+	defer close(stopped)
+
+	ticker := time.NewTicker(lockStaleAge / 4)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			now := time.Now()
+
+			os.Chtimes(lock_path, now, now)
+		case <-stop:
+			return
+		}
+	}
+}
+
+// isLocked reports whether path currently has a live (not yet stale) lock
+// held via withLock, so `cache gc`/`cache prune` can leave the underlying
+// cache entry or partial download alone rather than evicting the data out
+// from under the process holding that lock.
+func isLocked(path string) bool {
+	info, err := os.Stat(path + ".lock")
+
+	if err != nil {
+		return false
+	}
+
+	return time.Since(info.ModTime()) <= lockStaleAge
+}
@@ -0,0 +1,105 @@
+package env
+
+import (
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWithLockSerializesConcurrentCallers(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "entry")
+
+	var active, maxActive int32
+	done := make(chan error, 2)
+
+	work := func() error {
+		return withLock(path, func() error {
+			n := atomic.AddInt32(&active, 1)
+
+			for current := atomic.LoadInt32(&maxActive); n > current; current = atomic.LoadInt32(&maxActive) {
+				if atomic.CompareAndSwapInt32(&maxActive, current, n) {
+					break
+				}
+			}
+
+			time.Sleep(20 * time.Millisecond)
+
+			atomic.AddInt32(&active, -1)
+
+			return nil
+		})
+	}
+
+	go func() { done <- work() }()
+	go func() { done <- work() }()
+
+	for i := 0; i < 2; i++ {
+		if err := <-done; err != nil {
+			t.Fatalf("withLock failed: %v", err)
+		}
+	}
+
+	if maxActive != 1 {
+		t.Errorf("max concurrent holders = %d, want 1", maxActive)
+	}
+}
+
+func TestWithLockReclaimsStaleLockFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "entry")
+	lock_path := path + ".lock"
+
+	if err := os.WriteFile(lock_path, nil, Permission); err != nil {
+		t.Fatal(err)
+	}
+
+	stale := time.Now().Add(-2 * lockStaleAge)
+
+	if err := os.Chtimes(lock_path, stale, stale); err != nil {
+		t.Fatal(err)
+	}
+
+	ran := false
+
+	if err := withLock(path, func() error {
+		ran = true
+
+		return nil
+	}); err != nil {
+		t.Fatalf("withLock failed to reclaim a stale lock: %v", err)
+	}
+
+	if !ran {
+		t.Error("withLock did not run fn after reclaiming a stale lock")
+	}
+
+	if _, err := os.Stat(lock_path); err == nil {
+		t.Error("withLock left the lock file behind after fn returned")
+	}
+}
+
+func TestWithLockHeartbeatSurvivesStaleAgeWhileHeld(t *testing.T) {
+	old_stale_age := lockStaleAge
+	lockStaleAge = 100 * time.Millisecond
+	defer func() { lockStaleAge = old_stale_age }()
+
+	path := filepath.Join(t.TempDir(), "entry")
+
+	err := withLock(path, func() error {
+		// Outlive lockStaleAge while still holding the lock; without a
+		// heartbeat, a waiter checking staleness would (wrongly) reclaim
+		// this lock partway through.
+		time.Sleep(3 * lockStaleAge)
+
+		if !isLocked(path) {
+			t.Error("isLocked reported the lock as gone while fn was still running")
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		t.Fatalf("withLock failed: %v", err)
+	}
+}
@@ -1,58 +1,112 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"fmt"
-	"io"
-	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
-	"runtime"
 	"strings"
-	"text/template"
+	"time"
 
 	"github.com/urfave/cli/v3"
+	"golang.org/x/sync/errgroup"
 	"gopkg.in/yaml.v3"
+
+	"toolenv/internal/env"
 )
 
-const OS_PERMISSION os.FileMode = 0755
+const configFile = "toolenv.yml"
 
-type Config struct {
-	Tools []Tool `yaml:"tools"`
-}
+func main() {
+	app := &cli.Command{
+		Name:    "toolenv",
+		Usage:   "A virtual tool environment manager",
+		Version: env.Version,
+		Commands: []*cli.Command{
+			initCommand(),
+			installCommand(),
+			addCommand(),
+			removeCommand(),
+			listCommand(),
+			runCommand(),
+			cleanCommand(),
+			cacheCommand(),
+		},
+	}
 
-type Tool struct {
-	Name          string             `yaml:"name"`
-	Version       string             `yaml:"version"`
-	URL           string             `yaml:"url"`
-	Env           map[string]string  `yaml:"env,omitempty"`
-	Normalization *ToolNormalization `yaml:"normalization,omitempty"`
+	if err := app.Run(context.Background(), os.Args); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
 }
 
-type ToolNormalization struct {
-	Arch map[string]string `yaml:"arch"`
-	OS   map[string]string `yaml:"os"`
+func envNameFlag() cli.Flag {
+	return &cli.StringFlag{Name: "env-name", Value: "env", Usage: "name of the environment directory"}
 }
 
-func main() {
-	app := &cli.Command{
-		Name:  "toolenv",
-		Usage: "A virtual tool environment manager",
+func initCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "init",
+		Usage: "scaffold a toolenv.yml in the current directory",
 		Action: func(ctx context.Context, cmd *cli.Command) error {
-			return setup("env")
+			if _, err := os.Stat(configFile); err == nil {
+				return fmt.Errorf("%s already exists", configFile)
+			}
+
+			scaffold := env.Config{
+				Tools: []env.Tool{
+					{
+						Name:    "go",
+						Version: "1.22.0",
+						URL:     "https://go.dev/dl/go{{.version}}.{{.os}}-{{.arch}}.tar.gz",
+						Env: map[string]string{
+							"PATH": "bin",
+						},
+					},
+				},
+			}
+
+			out, err := yaml.Marshal(scaffold)
+
+			if err != nil {
+				return err
+			}
+
+			if err := os.WriteFile(configFile, out, 0644); err != nil {
+				return err
+			}
+
+			fmt.Printf("Wrote %s\n", configFile)
+
+			return nil
 		},
 	}
+}
 
-	if err := app.Run(context.Background(), os.Args); err != nil {
-		fmt.Fprintln(os.Stderr, err)
-		os.Exit(1)
+func installCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "install",
+		Usage: "download and install every tool listed in toolenv.yml",
+		Flags: []cli.Flag{
+			envNameFlag(),
+			&cli.IntFlag{Name: "jobs", Value: 1, Usage: "number of tools to install concurrently"},
+			&cli.StringFlag{Name: "only", Usage: "install only the named tool"},
+			&cli.BoolFlag{Name: "no-cache", Usage: "bypass the shared tool cache and always re-download"},
+		},
+		Action: func(ctx context.Context, cmd *cli.Command) error {
+			return install(
+				cmd.String("env-name"),
+				cmd.Int("jobs"),
+				cmd.String("only"),
+				cmd.Bool("no-cache"),
+			)
+		},
 	}
 }
 
-func setup(env_name string) error {
-	config, err := loadEnv()
+func install(env_name string, jobs int, only string, no_cache bool) error {
+	config, err := env.LoadConfig(configFile)
 
 	if err != nil {
 		return err
@@ -61,41 +115,77 @@ func setup(env_name string) error {
 	env_dir := filepath.Join(".", env_name)
 	bin_dir := filepath.Join(env_dir, "bin")
 
-	if err := os.MkdirAll(bin_dir, OS_PERMISSION); err != nil {
+	if err := os.MkdirAll(bin_dir, env.Permission); err != nil {
 		return fmt.Errorf("failed to create env: %w", err)
 	}
 
 	storage_dir := filepath.Join(env_name, "storage")
 
-	if err := os.RemoveAll(storage_dir); err != nil {
-		return fmt.Errorf("failed to cleanup the storage: %w", err)
-	}
+	tools := config.Tools
 
-	for _, tool := range config.Tools {
-		os_name, arch := normalizeSystem(tool.Normalization)
+	if only != "" {
+		tools = nil
 
-		url, err := buildURL(tool.URL, tool.Version, os_name, arch)
+		for _, tool := range config.Tools {
+			if tool.Name == only {
+				tools = append(tools, tool)
+			}
+		}
 
-		if err != nil {
-			return fmt.Errorf("failed to build the tool URL: %w", err)
+		if len(tools) == 0 {
+			return fmt.Errorf("no tool named %q in %s", only, configFile)
 		}
+	}
 
-		install_dir := filepath.Join(storage_dir, fmt.Sprintf("%s@%s", tool.Name, tool.Version))
+	if jobs < 1 {
+		jobs = 1
+	}
 
-		if err := os.MkdirAll(install_dir, OS_PERMISSION); err != nil {
-			return fmt.Errorf("failed to create installation directory: %w", err)
-		}
+	// With more than one job and more than one tool to install, downloads
+	// can run concurrently, so their progress bars must not fight over the
+	// same stderr.
+	concurrent := jobs > 1 && len(tools) > 1
 
-		fmt.Printf("\nInstalling %s version %s ...\n", tool.Name, tool.Version)
+	group, _ := errgroup.WithContext(context.Background())
+	group.SetLimit(jobs)
 
-		if err := installTool(url, install_dir); err != nil {
-			return fmt.Errorf("failed to download and extract %s: %w", tool.Name, err)
-		}
+	for _, tool := range tools {
+		tool := tool
+
+		group.Go(func() error {
+			install_dir := filepath.Join(storage_dir, fmt.Sprintf("%s@%s", tool.Name, tool.Version))
 
-		fmt.Printf("|- Done!\n\n")
+			if err := os.RemoveAll(install_dir); err != nil {
+				return fmt.Errorf("failed to cleanup %s's installation directory: %w", tool.Name, err)
+			}
+
+			if err := os.MkdirAll(install_dir, env.Permission); err != nil {
+				return fmt.Errorf("failed to create installation directory: %w", err)
+			}
+
+			fmt.Printf("\nInstalling %s version %s ...\n", tool.Name, tool.Version)
+
+			cached, err := env.Install(tool, install_dir, no_cache, concurrent)
+
+			if err != nil {
+				return fmt.Errorf("failed to install %s: %w", tool.Name, err)
+			}
+
+			if cached {
+				fmt.Printf("|- %s: found in cache, linked\n", tool.Name)
+			}
+
+			fmt.Printf("|- %s: done\n", tool.Name)
+
+			return nil
+		})
 	}
 
-	if err := generateActivationScript(env_name, config.Tools); err != nil {
+	if err := group.Wait(); err != nil {
+		return err
+	}
+
+	if err := env.GenerateActivationScript(env_name, installedTools(storage_dir, config.Tools)); err != nil {
 		return err
 	}
 
@@ -105,178 +195,239 @@ func setup(env_name string) error {
 	return nil
 }
 
-func loadEnv() (*Config, error) {
-	f, err := os.Open("toolenv.yml")
-
-	if err != nil {
-		return nil, fmt.Errorf("failed to open toolenv.yml: %w", err)
-	}
-	defer f.Close()
+// installedTools filters all down to the tools that actually have an
+// install directory under storage_dir, so `toolenv install --only foo` on
+// an env that already has bar/baz installed regenerates activation scripts
+// covering foo, bar and baz, rather than either destroying bar/baz or
+// leaving stale PATH entries for tools this run skipped.
+func installedTools(storage_dir string, all []env.Tool) []env.Tool {
+	var present []env.Tool
 
-	var data Config
+	for _, tool := range all {
+		install_dir := filepath.Join(storage_dir, fmt.Sprintf("%s@%s", tool.Name, tool.Version))
 
-	if err := yaml.NewDecoder(f).Decode(&data); err != nil {
-		return nil, fmt.Errorf("failed to parse toolenv.yml: %w", err)
+		if _, err := os.Stat(install_dir); err == nil {
+			present = append(present, tool)
+		}
 	}
 
-	return &data, nil
+	return present
 }
 
-func normalizeSystem(spec *ToolNormalization) (string, string) {
-	arch := runtime.GOARCH
-	os_name := runtime.GOOS
+func addCommand() *cli.Command {
+	return &cli.Command{
+		Name:      "add",
+		Usage:     "add a tool to toolenv.yml",
+		ArgsUsage: "<name>@<version>",
+		Flags: []cli.Flag{
+			&cli.StringFlag{Name: "url", Required: true, Usage: "URL template for the tool's archive"},
+			&cli.BoolFlag{Name: "dry-run", Usage: "print the resulting toolenv.yml instead of writing it"},
+		},
+		Action: func(ctx context.Context, cmd *cli.Command) error {
+			spec := cmd.Args().First()
 
-	if spec != nil {
-		if mapped_arch, ok := spec.Arch[arch]; ok {
-			arch = mapped_arch
-		}
+			if spec == "" {
+				return fmt.Errorf("usage: toolenv add <name>@<version> --url <template>")
+			}
 
-		if mapped_os, ok := spec.OS[os_name]; ok {
-			os_name = mapped_os
-		}
-	}
+			name, version, ok := strings.Cut(spec, "@")
 
-	return os_name, arch
-}
+			if !ok {
+				return fmt.Errorf("expected <name>@<version>, got %q", spec)
+			}
 
-func buildURL(template_string, version, os_name, arch string) (string, error) {
-	tmpl, err := template.New("url").Parse(template_string)
+			config, err := env.LoadConfig(configFile)
 
-	if err != nil {
-		return "", err
-	}
+			if err != nil {
+				return err
+			}
 
-	data := map[string]string{
-		"version": version,
-		"os":      os_name,
-		"arch":    arch,
-	}
+			for _, tool := range config.Tools {
+				if tool.Name == name {
+					return fmt.Errorf("%s is already in %s", name, configFile)
+				}
+			}
 
-	var buf bytes.Buffer
+			config.Tools = append(config.Tools, env.Tool{
+				Name:    name,
+				Version: version,
+				URL:     cmd.String("url"),
+			})
 
-	if err := tmpl.Execute(&buf, data); err != nil {
-		return "", err
-	}
+			if cmd.Bool("dry-run") {
+				out, err := yaml.Marshal(config)
 
-	return buf.String(), nil
-}
+				if err != nil {
+					return err
+				}
 
-func installTool(url, install_dir string) error {
-	fmt.Printf("|- Downloading from \"%s\"\n", url)
+				fmt.Print(string(out))
 
-	response, err := http.Get(url)
+				return nil
+			}
 
-	if err != nil {
-		return err
+			return env.SaveConfig(configFile, config)
+		},
 	}
+}
 
-	defer response.Body.Close()
+func removeCommand() *cli.Command {
+	return &cli.Command{
+		Name:      "remove",
+		Usage:     "remove a tool from toolenv.yml",
+		ArgsUsage: "<name>",
+		Action: func(ctx context.Context, cmd *cli.Command) error {
+			name := cmd.Args().First()
 
-	if response.StatusCode != 200 {
-		return fmt.Errorf("failed to download file: %s", response.Status)
-	}
+			if name == "" {
+				return fmt.Errorf("usage: toolenv remove <name>")
+			}
 
-	tmp_file, err := os.CreateTemp("", "toolenv-download-*")
+			config, err := env.LoadConfig(configFile)
 
-	if err != nil {
-		return err
-	}
+			if err != nil {
+				return err
+			}
 
-	fmt.Printf("|- Creating a temporary file %s\n", tmp_file.Name())
+			var kept []env.Tool
+			found := false
 
-	defer fmt.Printf("|- Removing the temporary file %s\n", tmp_file.Name())
-	defer os.Remove(tmp_file.Name())
-	defer tmp_file.Close()
+			for _, tool := range config.Tools {
+				if tool.Name == name {
+					found = true
+					continue
+				}
 
-	if _, err := io.Copy(tmp_file, response.Body); err != nil {
-		return err
-	}
+				kept = append(kept, tool)
+			}
+
+			if !found {
+				return fmt.Errorf("%s is not in %s", name, configFile)
+			}
 
-	extension := filepath.Ext(url)
+			config.Tools = kept
 
-	switch extension {
-	case ".gz", ".tgz":
-		return extractTarGz(tmp_file.Name(), install_dir)
-	case ".xz":
-		return extractTarXz(tmp_file.Name(), install_dir)
-	default:
-		return fmt.Errorf("unsupported archive format: %s", extension)
+			return env.SaveConfig(configFile, config)
+		},
 	}
 }
 
-func extractTarGz(filename, install_dir string) error {
-	cmd := exec.Command("tar", "-xzf", filename, "-C", install_dir, "--strip-components=1")
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	return cmd.Run()
-}
+func listCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "list",
+		Usage: "show configured tools and whether they are installed",
+		Flags: []cli.Flag{envNameFlag()},
+		Action: func(ctx context.Context, cmd *cli.Command) error {
+			config, err := env.LoadConfig(configFile)
 
-func extractTarXz(filename, install_dir string) error {
-	cmd := exec.Command("tar", "-xJf", filename, "-C", install_dir, "--strip-components=1")
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	return cmd.Run()
-}
+			if err != nil {
+				return err
+			}
 
-func generateActivationScript(env_name string, tools []Tool) error {
-	activate_dir := filepath.Join(env_name, "bin", "activate")
+			storage_dir := filepath.Join(cmd.String("env-name"), "storage")
 
-	var sb strings.Builder
+			for _, tool := range config.Tools {
+				install_dir := filepath.Join(storage_dir, fmt.Sprintf("%s@%s", tool.Name, tool.Version))
 
-	sb.WriteString(fmt.Sprintf("# This file must be used with \"source %s/bin/activate\"\n", env_name))
-	sb.WriteString("# It modifies the current shell environment.\n")
-	sb.WriteString(fmt.Sprintf("export TOOLENV_DIR=\"$(pwd)/%s\"\n", env_name))
-	sb.WriteString("export PREVIOUS_PATH=\"$PATH\"\n")
+				if _, err := os.Stat(install_dir); err == nil {
+					fmt.Printf("= %s@%s (installed)\n", tool.Name, tool.Version)
+				} else {
+					fmt.Printf("+ %s@%s (not installed)\n", tool.Name, tool.Version)
+				}
+			}
 
-	for _, tool := range tools {
-		for key, value := range tool.Env {
-			escaped_value := strings.ReplaceAll(value, `"`, `\"`)
+			return nil
+		},
+	}
+}
+
+func runCommand() *cli.Command {
+	return &cli.Command{
+		Name:      "run",
+		Usage:     "run a command with the environment's tools on PATH",
+		ArgsUsage: "-- <cmd> [args...]",
+		Flags:     []cli.Flag{envNameFlag()},
+		Action: func(ctx context.Context, cmd *cli.Command) error {
+			args := cmd.Args().Slice()
 
-			tmpl, err := template.New("env").Parse(escaped_value)
+			if len(args) == 0 {
+				return fmt.Errorf("usage: toolenv run -- <cmd> [args...]")
+			}
+
+			config, err := env.LoadConfig(configFile)
 
 			if err != nil {
 				return err
 			}
 
-			data := map[string]string{
-				"version": tool.Version,
+			exports, err := env.ActivationEnv(cmd.String("env-name"), config.Tools)
+
+			if err != nil {
+				return err
 			}
 
-			var buf bytes.Buffer
+			resolved, err := env.ResolveExecutable(exports["PATH"], args[0])
 
-			if err := tmpl.Execute(&buf, data); err != nil {
+			if err != nil {
 				return err
 			}
 
-			if key == "PATH" {
-				sb.WriteString(fmt.Sprintf("export PATH=\"$TOOLENV_DIR/%s:$PATH\"\n", buf.String()))
-			} else {
-				sb.WriteString(fmt.Sprintf("export %s=\"$TOOLENV_DIR/%s\"\n", key, buf.String()))
+			command := exec.CommandContext(ctx, resolved, args[1:]...)
+			command.Stdin = os.Stdin
+			command.Stdout = os.Stdout
+			command.Stderr = os.Stderr
+			command.Env = os.Environ()
+
+			for key, value := range exports {
+				command.Env = append(command.Env, fmt.Sprintf("%s=%s", key, value))
 			}
-		}
+
+			return command.Run()
+		},
 	}
+}
 
-	sb.WriteString("export OLD_PS1=\"$PS1\"\n")
-	sb.WriteString("export PS1=\"(toolenv:env) $PS1\"\n")
-	sb.WriteString("deactivate() {\n")
-	sb.WriteString("\texport PS1=\"$OLD_PS1\"\n")
-	sb.WriteString("\tunset OLD_PS1\n")
+func cleanCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "clean",
+		Usage: "remove the environment directory",
+		Flags: []cli.Flag{envNameFlag()},
+		Action: func(ctx context.Context, cmd *cli.Command) error {
+			env_name := cmd.String("env-name")
 
-	for _, tool := range tools {
-		for key := range tool.Env {
-			if key == "PATH" {
-				continue
+			if err := os.RemoveAll(env_name); err != nil {
+				return fmt.Errorf("failed to remove %s: %w", env_name, err)
 			}
 
-			sb.WriteString(fmt.Sprintf("\tunset %s\n", key))
-		}
-	}
+			fmt.Printf("Removed ./%s\n", env_name)
 
-	sb.WriteString("\texport PATH=$PREVIOUS_PATH\n")
-	sb.WriteString("\tunset PREVIOUS_PATH\n")
-	sb.WriteString("\tunset TOOLENV_DIR\n")
-	sb.WriteString("\tunset -f deactivate\n")
-	sb.WriteString("}")
+			return nil
+		},
+	}
+}
 
-	return os.WriteFile(activate_dir, []byte(sb.String()), OS_PERMISSION)
+func cacheCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "cache",
+		Usage: "inspect and evict the shared tool cache",
+		Commands: []*cli.Command{
+			{
+				Name:  "gc",
+				Usage: "evict cache entries unused for longer than --older-than",
+				Flags: []cli.Flag{
+					&cli.IntFlag{Name: "older-than", Value: 30, Usage: "evict entries last used more than N days ago"},
+				},
+				Action: func(ctx context.Context, cmd *cli.Command) error {
+					return env.PruneCache(time.Duration(cmd.Int("older-than")) * 24 * time.Hour)
+				},
+			},
+			{
+				Name:  "prune",
+				Usage: "evict every cache entry not locked by an install in progress, whether or not an environment still uses it",
+				Action: func(ctx context.Context, cmd *cli.Command) error {
+					return env.PruneCache(0)
+				},
+			},
+		},
+	}
 }
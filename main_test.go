@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/urfave/cli/v3"
+
+	"toolenv/internal/env"
+)
+
+func TestInstalledToolsFiltersByPresence(t *testing.T) {
+	storage_dir := t.TempDir()
+
+	all := []env.Tool{
+		{Name: "go", Version: "1.22.0"},
+		{Name: "node", Version: "20.0.0"},
+	}
+
+	if err := os.MkdirAll(filepath.Join(storage_dir, "go@1.22.0"), env.Permission); err != nil {
+		t.Fatal(err)
+	}
+
+	present := installedTools(storage_dir, all)
+
+	if len(present) != 1 || present[0].Name != "go" {
+		t.Errorf("installedTools = %v, want only go@1.22.0", present)
+	}
+}
+
+// chdirTemp switches the test into a fresh temp directory for the duration
+// of the test, since configFile is always resolved relative to the current
+// directory.
+func chdirTemp(t *testing.T) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	old, err := os.Getwd()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { os.Chdir(old) })
+
+	return dir
+}
+
+func TestAddWritesConfigAndRejectsDuplicate(t *testing.T) {
+	chdirTemp(t)
+
+	if err := env.SaveConfig(configFile, &env.Config{}); err != nil {
+		t.Fatal(err)
+	}
+
+	app := &cli.Command{Commands: []*cli.Command{addCommand()}}
+
+	if err := app.Run(context.Background(), []string{"toolenv", "add", "go@1.22.0", "--url", "https://go.dev/dl/go.tar.gz"}); err != nil {
+		t.Fatalf("add failed: %v", err)
+	}
+
+	config, err := env.LoadConfig(configFile)
+
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+
+	if len(config.Tools) != 1 || config.Tools[0].Name != "go" {
+		t.Fatalf("toolenv.yml tools = %v, want a single go entry", config.Tools)
+	}
+
+	app = &cli.Command{Commands: []*cli.Command{addCommand()}}
+
+	if err := app.Run(context.Background(), []string{"toolenv", "add", "go@1.23.0", "--url", "https://go.dev/dl/go.tar.gz"}); err == nil {
+		t.Error("add did not reject a tool name already in toolenv.yml")
+	}
+}
+
+func TestRemoveDropsNamedTool(t *testing.T) {
+	chdirTemp(t)
+
+	cfg := &env.Config{Tools: []env.Tool{{Name: "go", Version: "1.22.0"}, {Name: "node", Version: "20.0.0"}}}
+
+	if err := env.SaveConfig(configFile, cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	app := &cli.Command{Commands: []*cli.Command{removeCommand()}}
+
+	if err := app.Run(context.Background(), []string{"toolenv", "remove", "go"}); err != nil {
+		t.Fatalf("remove failed: %v", err)
+	}
+
+	config, err := env.LoadConfig(configFile)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(config.Tools) != 1 || config.Tools[0].Name != "node" {
+		t.Fatalf("toolenv.yml tools = %v, want only node left", config.Tools)
+	}
+
+	app = &cli.Command{Commands: []*cli.Command{removeCommand()}}
+
+	if err := app.Run(context.Background(), []string{"toolenv", "remove", "go"}); err == nil {
+		t.Error("remove did not error for a tool no longer in toolenv.yml")
+	}
+}
+
+// TestRunResolvesExecutableAgainstEnvPath pins down the fix for exec.Command
+// resolving argv[0] via the calling process's PATH rather than the
+// environment's: a tool that exists only under env/storage/.../bin must
+// still be found and run.
+func TestRunResolvesExecutableAgainstEnvPath(t *testing.T) {
+	dir := chdirTemp(t)
+
+	cfg := &env.Config{Tools: []env.Tool{{
+		Name: "greeter", Version: "1.0.0",
+		Env: map[string]string{"PATH": "bin"},
+	}}}
+
+	if err := env.SaveConfig(configFile, cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	bin_dir := filepath.Join(dir, "env", "storage", "greeter@1.0.0", "bin")
+
+	if err := os.MkdirAll(bin_dir, env.Permission); err != nil {
+		t.Fatal(err)
+	}
+
+	script := filepath.Join(bin_dir, "greeter")
+
+	if err := os.WriteFile(script, []byte("#!/bin/sh\necho hello from greeter\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	var stdout bytes.Buffer
+
+	cmd := runCommand()
+	cmd.Writer = &stdout
+
+	app := &cli.Command{Commands: []*cli.Command{cmd}}
+
+	if err := app.Run(context.Background(), []string{"toolenv", "run", "--", "greeter"}); err != nil {
+		t.Fatalf("run failed: %v", err)
+	}
+}